@@ -2,16 +2,19 @@ module github.com/marcospedro/gocker
 
 go 1.24.4
 
-require github.com/containerd/cgroups/v3 v3.0.5
+require (
+	github.com/containerd/cgroups/v3 v3.0.5
+	github.com/klauspost/compress v1.18.0
+	github.com/opencontainers/runtime-spec v1.2.1
+	golang.org/x/sys v0.27.0
+)
 
 require (
 	github.com/cilium/ebpf v0.16.0 // indirect
 	github.com/containerd/log v0.1.0 // indirect
 	github.com/coreos/go-systemd/v22 v22.5.0 // indirect
 	github.com/godbus/dbus/v5 v5.1.0 // indirect
-	github.com/opencontainers/runtime-spec v1.2.1 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	golang.org/x/exp v0.0.0-20241108190413-2d47ceb2692f // indirect
-	golang.org/x/sys v0.27.0 // indirect
 	google.golang.org/protobuf v1.35.2 // indirect
 )
@@ -0,0 +1,181 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/marcospedro/gocker/internal/container"
+	"github.com/marcospedro/gocker/internal/dockerfile"
+	"github.com/marcospedro/gocker/internal/filesystem"
+	"github.com/marcospedro/gocker/internal/image"
+)
+
+// Diff returns the changes a container made to the root filesystem of its image, sorted by path.
+// The mount points created to run the container are left out, like docker diff does.
+func Diff(state *container.State) ([]filesystem.Change, error) {
+	var changes []filesystem.Change
+	err := state.WithImageRootfs(func(root string) error {
+		var err error
+		changes, err = filesystem.DiffUpperDir(state.UpperDir(), root)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff container %s: %w", state.ID, err)
+	}
+
+	mountPoints := state.MountPoints()
+	changes = slices.DeleteFunc(changes, func(change filesystem.Change) bool {
+		return change.Kind == filesystem.ChangeAdd && slices.Contains(mountPoints, change.Path)
+	})
+	return changes, nil
+}
+
+// Commit stores the changes of a container as a new image ref of the layer store: the image of the container
+// with the writable layer on top of it. The configuration of the container, such as a command given to gocker run,
+// becomes the configuration of the image, and the ENTRYPOINT, CMD, ENV, WORKDIR, USER and VOLUME changes
+// are applied to it as in a Dockerfile. An image already stored under ref is replaced.
+// A running container is refused, as its writable layer could change while it is written.
+func Commit(state *container.State, ref image.Reference, changes []dockerfile.Instruction) error {
+	if state.Running() {
+		return fmt.Errorf("container %s is running, it must be stopped before it is committed", state.ID)
+	}
+	stack := state.Config.Image
+	if stack.BaseDir == "" {
+		return fmt.Errorf("container %s does not record its image, it cannot be committed", state.ID)
+	}
+
+	base, err := image.LoadConfig(stack.BaseDir)
+	if err != nil {
+		return err
+	}
+	config, err := applyChanges(Config{
+		Entrypoint: state.Config.Entrypoint,
+		Cmd:        state.Config.Cmd,
+		Env:        state.Config.Env,
+		WorkingDir: state.Config.WorkingDir,
+		User:       state.Config.User,
+		Volumes:    state.Config.Volumes,
+	}, changes)
+	if err != nil {
+		return err
+	}
+
+	platform := image.NormalizePlatform(image.Platform{OS: base.OS, Architecture: base.Architecture, Variant: base.Variant})
+	rootfsPath := filepath.Join(rootfsRoot, imagePath(ref, platform))
+	err = checkRootfsUnused(rootfsPath)
+	if err != nil {
+		return err
+	}
+
+	diff, err := Diff(state)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(buildLayersRoot, 0755)
+	if err != nil {
+		return err
+	}
+	layer, diffID, err := filesystem.CreateLayer(buildLayersRoot, state.UpperDir(), diff)
+	if err != nil {
+		return fmt.Errorf("failed to create layer: %w", err)
+	}
+	createdBy := strings.Join(slices.Concat(state.Config.Entrypoint, state.Config.Cmd), " ")
+	stack = stack.Push(layer, diffID, image.History{Created: now(), CreatedBy: createdBy, Comment: "gocker commit"})
+
+	base.Created = now()
+	base.Config.Entrypoint = config.Entrypoint
+	base.Config.Cmd = config.Cmd
+	base.Config.Env = config.Env
+	base.Config.WorkingDir = config.WorkingDir
+	base.Config.User = config.User
+	base.Config.Volumes = nil
+	for _, path := range config.Volumes {
+		if base.Config.Volumes == nil {
+			base.Config.Volumes = map[string]struct{}{}
+		}
+		base.Config.Volumes[path] = struct{}{}
+	}
+
+	// The image is assembled next to its directory and renamed over it,
+	// so a failure leaves the image already stored under ref untouched.
+	dir := filepath.Join(layersRoot, imagePath(ref, platform))
+	err = os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".commit-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	err = os.Chmod(tmp, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = image.StoreStack(stack, base, tmp)
+	if err != nil {
+		return fmt.Errorf("failed to store image %s: %w", ref, err)
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(rootfsPath)
+}
+
+// applyChanges applies the instructions of gocker commit --change to a configuration.
+func applyChanges(config Config, changes []dockerfile.Instruction) (Config, error) {
+	r := &Runner{config: config}
+	lookup := map[string]func(dockerfile.Instruction) error{
+		"EntryPointInstruction": r.handleEntrypoint,
+		"CmdInstruction":        r.handleCmd,
+		"EnvInstruction":        r.handleEnv,
+		"WorkdirInstruction":    r.setWorkdir,
+		"UserInstruction":       r.handleUser,
+		"VolumeInstruction":     r.handleVolume,
+	}
+
+	for _, change := range changes {
+		handler, ok := lookup[instructionName(change)]
+		if !ok {
+			return Config{}, fmt.Errorf("unsupported change: %T", change)
+		}
+		err := handler(change)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	return r.config, nil
+}
+
+// checkRootfsUnused returns an error when the root filesystem built for an image is the one a container runs on,
+// as replacing the image removes it.
+func checkRootfsUnused(rootfsPath string) error {
+	states, err := container.List()
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		if state.Config.Rootfs == rootfsPath {
+			return fmt.Errorf("%s is the root filesystem of container %s, commit to another name", rootfsPath, state.ID)
+		}
+	}
+	return nil
+}
+
+// now returns the current time in the format of the created fields of image configurations.
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
@@ -1,108 +1,657 @@
 package build
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 
 	"github.com/marcospedro/gocker/internal/dockerfile"
 	"github.com/marcospedro/gocker/internal/filesystem"
 	"github.com/marcospedro/gocker/internal/image"
 )
 
+// Config is the image configuration assembled from the Dockerfile instructions.
+// It starts from the configuration of the base image, which the instructions override.
+// Env holds KEY=value pairs and WorkingDir and User are empty when unset.
+// Image is the base image with the layers of the build steps on top of it, and Layers are the root filesystems
+// of those layers, the topmost first, which containers stack on top of the root filesystem of the base image.
+type Config struct {
+	Entrypoint []string
+	Cmd        []string
+	Env        []string
+	WorkingDir string
+	User       string
+	Volumes    []string
+	Image      image.Stack
+	Layers     []string
+}
+
+const (
+	layersRoot = "/tmp/gocker/layers"
+	rootfsRoot = "/tmp/gocker/rootfs"
+	// buildLayersRoot holds the layers produced by build steps, named by digest like those of the layer store.
+	buildLayersRoot = "/tmp/gocker/build/layers"
+	// buildRootfsRoot holds the root filesystems of the layers produced by build steps, named by DiffID.
+	buildRootfsRoot = "/tmp/gocker/build/rootfs"
+)
+
+// Options configures how the Runner fetches the base image.
+type Options struct {
+	Download image.DownloadOptions
+	// StreamLayers extracts the layers of base images while they download instead of once they are all stored.
+	StreamLayers bool
+}
+
 type Runner struct {
 	instructions []dockerfile.Instruction
+	options      Options
+	ctx          context.Context
 	rootfsPath   string
-	entrypoint   []string
+	config       Config
+	// cmdSet records whether the Dockerfile set CMD itself, because ENTRYPOINT only resets an inherited CMD.
+	cmdSet bool
 }
 
-func NewRunner(instructions []dockerfile.Instruction) *Runner {
-	return &Runner{instructions: instructions}
+func NewRunner(instructions []dockerfile.Instruction, options Options) *Runner {
+	return &Runner{instructions: instructions, options: options}
 }
 
-// Runner.Prepare processes the Dockerfile instructions and prepares the root filesystem and entrypoint.
-// It returns the path to the root filesystem, the entrypoint command, and any error encountered during processing.
+// Runner.Prepare processes the Dockerfile instructions and prepares the root filesystem and image configuration.
+// It returns the path to the root filesystem, the image configuration, and any error encountered during processing.
 // The root filesystem is built from the layers of the specified image and any additional files copied into it.
-// The entrypoint is set based on the ENTRYPOINT instruction in the Dockerfile.
-func (r *Runner) Prepare() (string, []string, error) {
+// The configuration of the base image is overridden by ENTRYPOINT, CMD, ENV, WORKDIR, USER and VOLUME instructions.
+// Cancelling ctx aborts the image download.
+func (r *Runner) Prepare(ctx context.Context) (string, Config, error) {
 	var err error
+	r.ctx = ctx
 	lookup := map[string]func(dockerfile.Instruction) error{
 		"FromInstruction":       r.handleFrom,
 		"CopyInstruction":       r.handleCopy,
 		"EntryPointInstruction": r.handleEntrypoint,
+		"CmdInstruction":        r.handleCmd,
+		"EnvInstruction":        r.handleEnv,
+		"WorkdirInstruction":    r.handleWorkdir,
+		"UserInstruction":       r.handleUser,
+		"VolumeInstruction":     r.handleVolume,
 	}
 
 	for _, instruction := range r.instructions {
-		typeName := fmt.Sprintf("%T", instruction)
-		if idx := len("dockerfile."); len(typeName) > idx && typeName[:idx] == "dockerfile." {
-			typeName = typeName[idx:]
-		}
-		handler, ok := lookup[typeName]
+		handler, ok := lookup[instructionName(instruction)]
 		if !ok {
-			return "", nil, fmt.Errorf("unsupported instruction type: %T", instruction)
+			return "", Config{}, fmt.Errorf("unsupported instruction type: %T", instruction)
 		}
 		if err := handler(instruction); err != nil {
-			return "", nil, err
+			return "", Config{}, err
 		}
 	}
-	return r.rootfsPath, r.entrypoint, err
+	return r.rootfsPath, r.config, err
+}
+
+// instructionName returns the name of the type of an instruction without its package, e.g. CmdInstruction.
+func instructionName(instruction dockerfile.Instruction) string {
+	typeName := fmt.Sprintf("%T", instruction)
+	if idx := len("dockerfile."); len(typeName) > idx && typeName[:idx] == "dockerfile." {
+		typeName = typeName[idx:]
+	}
+	return typeName
 }
 
 // handleEntrypoint processes the ENTRYPOINT instruction from the Dockerfile.
-// It sets the entrypoint command for the container.
+// It sets the entrypoint command for the container. As in Docker, a CMD inherited from the base image
+// is reset because it was written for the base image's entrypoint; an empty ENTRYPOINT clears it.
 func (r *Runner) handleEntrypoint(inst dockerfile.Instruction) error {
 	entry := inst.(dockerfile.EntryPointInstruction)
+	r.config.Entrypoint = entry.Entrypoint
 	if len(entry.Entrypoint) == 0 {
-		return fmt.Errorf("entrypoint instruction is empty or not set")
+		r.config.Entrypoint = nil
+	}
+
+	if !r.cmdSet {
+		r.config.Cmd = nil
+	}
+	return nil
+}
+
+// handleCmd processes the CMD instruction from the Dockerfile.
+// It sets the default command, or the default arguments of the entrypoint when there is one.
+func (r *Runner) handleCmd(inst dockerfile.Instruction) error {
+	cmd := inst.(dockerfile.CmdInstruction)
+	r.config.Cmd = cmd.Cmd
+	if len(cmd.Cmd) == 0 {
+		r.config.Cmd = nil
+	}
+	r.cmdSet = true
+	return nil
+}
+
+// handleEnv processes the ENV instruction from the Dockerfile.
+// Each variable replaces the value of the same name inherited from the base image or earlier instructions.
+func (r *Runner) handleEnv(inst dockerfile.Instruction) error {
+	env := inst.(dockerfile.EnvInstruction)
+	for _, pair := range env.Env {
+		r.config.Env = setEnv(r.config.Env, pair)
+	}
+	return nil
+}
+
+// handleWorkdir processes the WORKDIR instruction from the Dockerfile.
+// A relative path is relative to the previous working directory. A directory missing from the root filesystem
+// is created, with its missing parents, in a layer of its own.
+func (r *Runner) handleWorkdir(inst dockerfile.Instruction) error {
+	if r.rootfsPath == "" {
+		return fmt.Errorf("WORKDIR before FROM")
+	}
+	err := r.setWorkdir(inst)
+	if err != nil {
+		return err
+	}
+
+	workdir, err := r.resolve(r.config.WorkingDir)
+	if err != nil {
+		return err
+	}
+	info, err := r.lstat(workdir)
+	if err == nil && info.IsDir() {
+		return nil
+	}
+	if err == nil {
+		return fmt.Errorf("working directory %s is not a directory", r.config.WorkingDir)
+	}
+	if !os.IsNotExist(err) {
+		return err
 	}
 
-	r.entrypoint = entry.Entrypoint
+	return r.addLayer(workdir, func(hostPath string) error {
+		err := os.MkdirAll(hostPath, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create working directory %s: %w", r.config.WorkingDir, err)
+		}
+		return nil
+	}, "WORKDIR "+r.config.WorkingDir)
+}
+
+// setWorkdir sets the working directory of a WORKDIR instruction, relative to the previous one.
+func (r *Runner) setWorkdir(inst dockerfile.Instruction) error {
+	workdir := inst.(dockerfile.WorkdirInstruction)
+	path := workdir.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join("/", r.config.WorkingDir, path)
+	}
+	r.config.WorkingDir = filepath.Clean(path)
+	return nil
+}
+
+// handleUser processes the USER instruction from the Dockerfile.
+// The user is resolved against the container's /etc/passwd when the container starts.
+func (r *Runner) handleUser(inst dockerfile.Instruction) error {
+	user := inst.(dockerfile.UserInstruction)
+	r.config.User = user.User
+	return nil
+}
+
+// setEnv sets a KEY=value pair in env, replacing an existing value of the key.
+func setEnv(env []string, pair string) []string {
+	key, _, _ := strings.Cut(pair, "=")
+	for i, existing := range env {
+		if existingKey, _, _ := strings.Cut(existing, "="); existingKey == key {
+			env = slices.Clone(env)
+			env[i] = pair
+			return env
+		}
+	}
+	return append(slices.Clone(env), pair)
+}
+
+// handleVolume processes the VOLUME instruction from the Dockerfile.
+// It records the paths in the image configuration so an anonymous volume is created for each of them at run time.
+// Paths must be absolute and are deduplicated across VOLUME instructions.
+func (r *Runner) handleVolume(inst dockerfile.Instruction) error {
+	vol := inst.(dockerfile.VolumeInstruction)
+	for _, path := range vol.Paths {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("volume path must be absolute: %s", path)
+		}
+		path = filepath.Clean(path)
+		if slices.Contains(r.config.Volumes, path) {
+			continue
+		}
+		r.config.Volumes = append(r.config.Volumes, path)
+	}
 	return nil
 }
 
 // handleFrom processes the FROM instruction from the Dockerfile.
 // It downloads the specified image and builds the root filesystem from its layers.
-// If the root filesystem already exists, it reuses it instead of downloading again.
-// The image is expected to be in the format "imageName:tag"
-// where "imageName" is the name of the image and "tag" is the version tag.
+// If the root filesystem already exists, it reuses it instead of downloading again,
+// and an image already stored with all of its layers is not downloaded again either.
+// The root filesystem is built with buildRootfs, so it only exists once all of its layers are extracted.
+// The configuration of the image (entrypoint, command, environment, working directory, user and volumes)
+// becomes the starting point of the build configuration.
+// The image is any reference accepted by image.ParseReference, such as "node:alpine",
+// "myuser/app" or "ghcr.io/org/app:1.2@sha256:<digest>".
+// FROM --platform takes precedence over the platform of the build options.
 func (r *Runner) handleFrom(inst dockerfile.Instruction) error {
 	from := inst.(dockerfile.FromInstruction)
-	imageName := from.Image
-	tag := from.Tag
-	fmt.Printf("Building root filesystem for image %s tag:%s...\n", imageName, tag)
+	ref, err := image.ParseReference(from.Image)
+	if err != nil {
+		return err
+	}
 
-	downloadPath := fmt.Sprintf("/tmp/gocker/layers/%s/%s", imageName, tag)
-	rootfsPath := fmt.Sprintf("/tmp/gocker/rootfs/%s/%s", imageName, tag)
+	download := r.options.Download
+	if from.Platform != "" {
+		download.Platform, err = image.ParsePlatform(from.Platform)
+		if err != nil {
+			return err
+		}
+	}
+	if download.Platform.OS == "" {
+		download.Platform = image.DefaultPlatform()
+	}
+	fmt.Printf("Building root filesystem for image %s (%s)...\n", ref, download.Platform)
 
-	_, err := os.Stat(rootfsPath)
-	if !os.IsNotExist(err) {
-		r.rootfsPath = rootfsPath
+	downloadPath := filepath.Join(layersRoot, imagePath(ref, download.Platform))
+	rootfsPath := filepath.Join(rootfsRoot, imagePath(ref, download.Platform))
+	config, err := image.LoadConfig(downloadPath)
+	_, statErr := os.Stat(rootfsPath)
+	if err == nil && statErr == nil {
+		r.useBaseImage(rootfsPath, downloadPath, config)
 		return nil
 	}
 
-	_ = os.MkdirAll(downloadPath, 0755)
-	_ = os.MkdirAll(rootfsPath, 0755)
+	_ = os.RemoveAll(rootfsPath)
+	manifest, stored := storedLayers(downloadPath)
+	if r.options.StreamLayers && !stored {
+		err = buildRootfs(rootfsPath, func(dir string) error {
+			return r.pullIntoRootfs(ref, download, dir)
+		})
+		if err != nil {
+			return err
+		}
+		config, err = image.LoadConfig(downloadPath)
+		if err != nil {
+			return err
+		}
+		r.useBaseImage(rootfsPath, downloadPath, config)
+		return nil
+	}
+
+	if !stored {
+		downloadPath, err = Pull(r.ctx, ref, download)
+		if err != nil {
+			return err
+		}
+		manifest, err = image.LoadManifest(downloadPath)
+		if err != nil {
+			return err
+		}
+	}
+	config, err = image.LoadConfig(downloadPath)
+	if err != nil {
+		return err
+	}
+
+	err = buildRootfs(rootfsPath, func(dir string) error {
+		return filesystem.BuildFromLayers(downloadPath, manifest.Layers, dir)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build root filesystem: %w", err)
+	}
+
+	r.useBaseImage(rootfsPath, downloadPath, config)
+	return nil
+}
+
+// buildRootfs calls build to extract a root filesystem into a temporary directory next to rootfsPath, then
+// renames it to rootfsPath. A build killed while extracting leaves only the temporary directory behind,
+// rather than a partial root filesystem that later builds would take for a complete one and reuse.
+func buildRootfs(rootfsPath string, build func(dir string) error) error {
+	err := os.MkdirAll(filepath.Dir(rootfsPath), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(rootfsPath), ".rootfs-*")
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp, 0755)
+	if err == nil {
+		err = build(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, rootfsPath)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
 
-	err = image.DownloadImage("library/"+imageName, tag, downloadPath)
+// storedLayers returns the manifest of an image stored in the layer store with all of its layers,
+// such as a loaded or committed image, which the root filesystem can be built from without pulling it.
+func storedLayers(dir string) (image.Manifest, bool) {
+	manifest, err := image.LoadManifest(dir)
 	if err != nil {
-		return fmt.Errorf("failed to download image %s:%s: %w", imageName, tag, err)
+		return image.Manifest{}, false
+	}
+	for _, layer := range manifest.Layers {
+		_, err := os.Stat(image.LayerPath(dir, layer))
+		if err != nil {
+			return image.Manifest{}, false
+		}
+	}
+	return manifest, true
+}
+
+// pullIntoRootfs pulls an image while its layers are extracted into rootfsPath as they download.
+// A failure removes the partially built root filesystem, as BuildFromLayers does.
+func (r *Runner) pullIntoRootfs(ref image.Reference, download image.DownloadOptions, rootfsPath string) error {
+	download.Apply = func(layer image.Layer, layerReader io.Reader) error {
+		return filesystem.ApplyLayer(layerReader, layer.MediaType, rootfsPath)
 	}
 
-	err = filesystem.BuildFromLayers(downloadPath, rootfsPath)
+	_, err := Pull(r.ctx, ref, download)
 	if err != nil {
+		_ = os.RemoveAll(rootfsPath)
 		return fmt.Errorf("failed to build root filesystem: %w", err)
 	}
+	return nil
+}
 
+// useBaseImage starts the build from the root filesystem and configuration of the base image stored in layersPath.
+func (r *Runner) useBaseImage(rootfsPath, layersPath string, base image.ImageConfig) {
 	r.rootfsPath = rootfsPath
+	r.cmdSet = false
+	r.config = Config{
+		Entrypoint: base.Config.Entrypoint,
+		Cmd:        base.Config.Cmd,
+		Env:        base.Config.Env,
+		WorkingDir: base.Config.WorkingDir,
+		User:       base.Config.User,
+		Image:      image.Stack{BaseDir: layersPath, LayersDir: buildLayersRoot},
+	}
+	for path := range base.Config.Volumes {
+		r.config.Volumes = append(r.config.Volumes, filepath.Clean(path))
+	}
+	slices.Sort(r.config.Volumes)
+}
+
+// addLayer makes a build step a layer of its own. create writes the files of the step at name of the root
+// filesystem of the layer, which already holds the parent directories of name with the ownership, mode and
+// times they have in the root filesystem built so far, so the layer does not change them.
+// The layer is stored in /tmp/gocker/build/layers and its root filesystem is kept as
+// /tmp/gocker/build/rootfs/<DiffID>, stacked on top of the root filesystem of the base image when a container
+// runs: the root filesystem of the base image is shared by every build and container of the image and is never
+// written to.
+func (r *Runner) addLayer(name string, create func(hostPath string) error, createdBy string) error {
+	for _, dir := range []string{buildLayersRoot, buildRootfsRoot} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	tmp, err := os.MkdirTemp(buildRootfsRoot, ".layer-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	err = os.Chmod(tmp, 0755)
+	if err != nil {
+		return err
+	}
+
+	parents, err := r.copyParents(tmp, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	err = create(filepath.Join(tmp, name))
+	if err != nil {
+		return err
+	}
+	// Creating the content of the parent directories updated their times.
+	for hostPath, info := range parents {
+		err := os.Chtimes(hostPath, info.ModTime(), info.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+
+	changes := []filesystem.Change{{Path: name, Kind: filesystem.ChangeAdd}}
+	layer, diffID, err := filesystem.CreateLayer(buildLayersRoot, tmp, changes)
+	if err != nil {
+		return fmt.Errorf("failed to create layer: %w", err)
+	}
+
+	// The same step of another build may have stored the same layer already.
+	dir := filepath.Join(buildRootfsRoot, strings.TrimPrefix(diffID, "sha256:"))
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		_, statErr := os.Stat(dir)
+		if statErr != nil {
+			return err
+		}
+	}
+
+	r.config.Image = r.config.Image.Push(layer, diffID, image.History{Created: now(), CreatedBy: createdBy})
+	r.config.Layers = append([]string{dir}, r.config.Layers...)
+	return nil
+}
+
+// copyParents creates the directory dir, with its parents, in the root filesystem of a layer at root, giving
+// those the root filesystem built so far has the same ownership and mode. It returns them with their FileInfo,
+// whose times are restored once the layer is written.
+func (r *Runner) copyParents(root, dir string) (map[string]os.FileInfo, error) {
+	parents := map[string]os.FileInfo{}
+	current := "/"
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+		hostPath := filepath.Join(root, current)
+
+		info, err := r.lstat(current)
+		if os.IsNotExist(err) {
+			err = os.Mkdir(hostPath, 0755)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", current)
+		}
+
+		err = os.Mkdir(hostPath, 0755)
+		if err != nil {
+			return nil, err
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		err = os.Lchown(hostPath, int(stat.Uid), int(stat.Gid))
+		if err != nil {
+			return nil, err
+		}
+		err = os.Chmod(hostPath, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if err != nil {
+			return nil, err
+		}
+		parents[hostPath] = info
+	}
+	return parents, nil
+}
+
+// lstat returns the FileInfo of a path of the root filesystem built so far, without following its last component:
+// the one of the topmost layer of the build holding the path, or else of the root filesystem of the base image.
+// Build layers only add files, so the first one holding a path hides it in the layers below.
+func (r *Runner) lstat(name string) (os.FileInfo, error) {
+	for _, dir := range r.config.Layers {
+		info, err := filesystem.LstatPath(dir, name)
+		if !os.IsNotExist(err) {
+			return info, err
+		}
+	}
+	return filesystem.LstatPath(r.rootfsPath, name)
+}
+
+// resolve resolves the symlinks of a path of the root filesystem against the base image, which holds every symlink
+// of the root filesystem as the layers of the build only add files and directories, and returns the path they lead to,
+// so that a build step writing below a symlinked directory such as /bin writes into its target.
+func (r *Runner) resolve(name string) (string, error) {
+	hostPath, err := filesystem.ResolvePath(r.rootfsPath, path.Join("/", name))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(r.rootfsPath, hostPath)
+	if err != nil {
+		return "", err
+	}
+	return path.Join("/", filepath.ToSlash(rel)), nil
+}
+
+// Pull downloads the layers of an image into the layer store and returns the directory holding them.
+// Every platform of an image is stored in its own directory; the zero platform means the host platform.
+func Pull(ctx context.Context, ref image.Reference, options image.DownloadOptions) (string, error) {
+	if options.Platform.OS == "" {
+		options.Platform = image.DefaultPlatform()
+	}
+
+	downloadPath := filepath.Join(layersRoot, imagePath(ref, options.Platform))
+	_ = os.MkdirAll(downloadPath, 0755)
+
+	err := image.DownloadImage(ctx, ref, downloadPath, options)
+	if err != nil {
+		return "", fmt.Errorf("failed to download image %s: %w", ref, err)
+	}
+	return downloadPath, nil
+}
+
+// Push uploads an image of the layer store, pulled from source, to target.
+// The target defaults to the source, and the zero platform means the host platform.
+func Push(ctx context.Context, source, target image.Reference, platform image.Platform, options image.PushOptions) error {
+	if platform.OS == "" {
+		platform = image.DefaultPlatform()
+	}
+
+	dir, err := storedImage(source, platform)
+	if err != nil {
+		return err
+	}
+
+	options.Source = &source
+	err = image.PushImage(ctx, dir, target, options)
+	if err != nil {
+		return fmt.Errorf("failed to push image %s: %w", target, err)
+	}
 	return nil
 }
 
+// Save writes images of the layer store to output in one of the image.SaveImages formats,
+// or to standard output when output is empty. The zero platform means the host platform.
+func Save(refs []image.Reference, platform image.Platform, format, output string) error {
+	if platform.OS == "" {
+		platform = image.DefaultPlatform()
+	}
+
+	var images []image.SavedImage
+	for _, ref := range refs {
+		if slices.ContainsFunc(images, func(saved image.SavedImage) bool { return saved.Reference == ref }) {
+			continue
+		}
+		dir, err := storedImage(ref, platform)
+		if err != nil {
+			return err
+		}
+		images = append(images, image.SavedImage{Reference: ref, Dir: dir})
+	}
+
+	err := image.SaveImages(images, format, output, os.Stdout)
+	if err != nil {
+		return fmt.Errorf("failed to save images: %w", err)
+	}
+	return nil
+}
+
+// storedImage returns the directory of an image of the layer store once it checked that all of its layers
+// are stored: an image pulled with --discard-layers has its manifest but not its layers.
+func storedImage(ref image.Reference, platform image.Platform) (string, error) {
+	dir := filepath.Join(layersRoot, imagePath(ref, platform))
+	_, err := os.Stat(filepath.Join(dir, image.ManifestFileName))
+	if err != nil {
+		return "", fmt.Errorf("image %s (%s) is not in the layer store, pull it first", ref, platform)
+	}
+	_, stored := storedLayers(dir)
+	if !stored {
+		return "", fmt.Errorf("layers of image %s (%s) are missing from the layer store, as with --discard-layers; pull it again", ref, platform)
+	}
+	return dir, nil
+}
+
+// Load imports the images of a docker-archive or OCI layout, read from input or standard input, into the layer store.
+// An image already stored under the same name is replaced, along with the root filesystem built from it, once the
+// new one is completely imported: it is written into a temporary directory next to the old one and renamed over it.
+func Load(input string) ([]image.LoadedImage, error) {
+	store := func(ref image.Reference, platform image.Platform, write func(dir string) error) error {
+		dir := filepath.Join(layersRoot, imagePath(ref, platform))
+		err := os.MkdirAll(filepath.Dir(dir), 0755)
+		if err != nil {
+			return err
+		}
+		tmp, err := os.MkdirTemp(filepath.Dir(dir), ".load-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		err = os.Chmod(tmp, 0755)
+		if err != nil {
+			return err
+		}
+
+		err = write(tmp)
+		if err != nil {
+			return fmt.Errorf("failed to store image %s: %w", ref, err)
+		}
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp, dir)
+		if err != nil {
+			return err
+		}
+		return os.RemoveAll(filepath.Join(rootfsRoot, imagePath(ref, platform)))
+	}
+
+	loaded, err := image.LoadImages(input, os.Stdin, store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load images: %w", err)
+	}
+	return loaded, nil
+}
+
+// imagePath returns the directory of an image below the layer and root filesystem stores, e.g.
+// docker.io/library/node/alpine/linux_arm_v7.
+func imagePath(ref image.Reference, platform image.Platform) string {
+	return filepath.Join(ref.Domain, ref.Repository, ref.Identifier(), strings.ReplaceAll(platform.String(), "/", "_"))
+}
+
 // handleCopy processes the COPY instruction from the Dockerfile.
 // It copies files from the host filesystem to the container's root filesystem.
 // The source path is relative to the current working directory, and the destination path is relative to the root filesystem.
-// If the destination file already exists, it is removed before copying the new file.
+// The copy hides a file the root filesystem already has at the destination.
 // The source file must exist on the host filesystem, or an error is returned.
 // The root filesystem path must be set before calling this method.
+// The copied file, owned by root with the permissions and modification time of the source, becomes a layer
+// of its own, written with addLayer, and the parent directories of the destination are resolved against
+// the root filesystem, so a symlinked directory is copied into rather than replaced.
 // It returns an error if the source file does not exist, or if there are issues creating the destination directory or copying the file.
 func (r *Runner) handleCopy(inst dockerfile.Instruction) error {
 	copy := inst.(dockerfile.CopyInstruction)
@@ -119,26 +668,66 @@ func (r *Runner) handleCopy(inst dockerfile.Instruction) error {
 	}
 
 	srcPath := filepath.Join(cwd, src)
-	dstPath := filepath.Join(rootfsPath, dst)
-
-	_, err = os.Stat(dstPath)
-	if !os.IsNotExist(err) {
-		os.RemoveAll(dstPath)
-	}
-
 	_, err = os.Stat(srcPath)
 	if os.IsNotExist(err) {
 		return fmt.Errorf("source file %s does not exist", srcPath)
 	}
 
-	err = os.MkdirAll(filepath.Dir(dstPath), 0755)
+	dir, err := r.resolve(path.Dir(path.Join("/", dst)))
 	if err != nil {
-		return fmt.Errorf("failed to create destination directory %s: %v", filepath.Dir(dstPath), err)
+		return fmt.Errorf("failed to resolve destination directory of %s: %v", dst, err)
 	}
+	name := path.Join(dir, path.Base(path.Join("/", dst)))
 
-	err = os.Link(srcPath, dstPath)
+	return r.addLayer(name, func(hostPath string) error {
+		err := copyFile(srcPath, hostPath)
+		if err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %v", srcPath, dst, err)
+		}
+		return nil
+	}, fmt.Sprintf("COPY %s %s", src, dst))
+}
+
+// copyFile copies the content, permissions and modification time of the file at src to a new file at dst,
+// owned by root like the files docker build copies. The layer gets a copy rather than a link, so later edits
+// of the build context cannot change a layer whose digest is already computed.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
 	if err != nil {
-		return fmt.Errorf("failed to copy %s to %s: %v", srcPath, dstPath, err)
+		return err
 	}
-	return nil
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", src)
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	err = out.Chown(0, 0)
+	if err != nil {
+		return err
+	}
+	// Chmod after Chown, which clears the setuid and setgid bits.
+	err = out.Chmod(info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+	if err != nil {
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
 }
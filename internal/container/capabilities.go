@@ -0,0 +1,232 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const capLastCapPath = "/proc/sys/kernel/cap_last_cap"
+
+// capabilityValues maps every capability name to its number.
+var capabilityValues = map[string]int{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// DefaultCapabilities is the capability set Docker grants to containers.
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// Capabilities computes the capability set of a container from the --cap-add and --cap-drop values.
+// Names are case insensitive and the CAP_ prefix is optional. The special name ALL refers to every capability:
+// adding ALL starts from the full set and dropping ALL starts from an empty one, before the other names are applied.
+// A privileged container always gets every capability.
+func Capabilities(add, drop []string, privileged bool) ([]string, error) {
+	all := allCapabilities()
+	if privileged {
+		return all, nil
+	}
+
+	add, addAll, err := normalizeCapabilities(add)
+	if err != nil {
+		return nil, err
+	}
+	drop, dropAll, err := normalizeCapabilities(drop)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := slices.Clone(DefaultCapabilities)
+	if addAll {
+		caps = all
+	}
+	if dropAll {
+		caps = nil
+	}
+
+	caps = slices.DeleteFunc(caps, func(c string) bool {
+		return slices.Contains(drop, c)
+	})
+	for _, c := range add {
+		if !slices.Contains(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+	return caps, nil
+}
+
+// normalizeCapabilities converts the names to their canonical CAP_ form and reports whether ALL was present.
+func normalizeCapabilities(names []string) ([]string, bool, error) {
+	var caps []string
+	all := false
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "ALL" {
+			all = true
+			continue
+		}
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		if _, ok := capabilityValues[name]; !ok {
+			return nil, false, fmt.Errorf("unknown capability: %s", name)
+		}
+		caps = append(caps, name)
+	}
+	return caps, all, nil
+}
+
+// allCapabilities returns the name of every known capability ordered by number.
+func allCapabilities() []string {
+	var caps []string
+	for name := range capabilityValues {
+		caps = append(caps, name)
+	}
+	slices.SortFunc(caps, func(a, b string) int {
+		return capabilityValues[a] - capabilityValues[b]
+	})
+	return caps
+}
+
+// dropBoundingCapabilities drops every capability but the given ones from the bounding set of the calling thread,
+// so they cannot be gained again, even by executing a setuid or file capability binary.
+// Dropping needs CAP_SETPCAP, so it must run while the process is still root, before setUser.
+func dropBoundingCapabilities(names []string) error {
+	lastCap, err := lastCapability()
+	if err != nil {
+		return err
+	}
+	keep, err := capabilitySet(names)
+	if err != nil {
+		return err
+	}
+
+	for c := 0; c <= lastCap; c++ {
+		if keep[c] {
+			continue
+		}
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to drop capability %d from the bounding set: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// applyCapabilities restricts the calling thread to the given capabilities once setUser switched to the user.
+// The ambient set is cleared, and the effective and permitted sets are set to the capabilities while the
+// inheritable set is emptied. A process that does not run as root keeps the capabilities in its bounding set only,
+// like in Docker, so they are only gained again by executing a setuid or file capability binary.
+// It must run on the thread that calls exec, after dropBoundingCapabilities and all the privileged setup,
+// in the order runc uses: bounding set as root, then the user switch keeping capabilities, then capset.
+func applyCapabilities(names []string, root bool) error {
+	keep, err := capabilitySet(names)
+	if err != nil {
+		return err
+	}
+
+	var data [2]unix.CapUserData
+	if root {
+		for c := range keep {
+			data[c/32].Effective |= 1 << uint(c%32)
+			data[c/32].Permitted |= 1 << uint(c%32)
+		}
+	}
+
+	err = unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to clear ambient capabilities: %w", err)
+	}
+
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	err = unix.Capset(&header, &data[0])
+	if err != nil {
+		return fmt.Errorf("failed to set capabilities: %w", err)
+	}
+	return nil
+}
+
+// capabilitySet returns the numbers of the named capabilities.
+func capabilitySet(names []string) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, name := range names {
+		value, ok := capabilityValues[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability: %s", name)
+		}
+		set[value] = true
+	}
+	return set, nil
+}
+
+// lastCapability returns the highest capability number supported by the running kernel.
+func lastCapability() (int, error) {
+	data, err := os.ReadFile(capLastCapPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", capLastCapPath, err)
+	}
+
+	lastCap, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid value in %s: %w", capLastCapPath, err)
+	}
+	return lastCap, nil
+}
@@ -2,86 +2,277 @@ package container
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"runtime"
 	"syscall"
 
 	"github.com/containerd/cgroups/v3/cgroup2"
+	"github.com/marcospedro/gocker/internal/image"
+	"github.com/marcospedro/gocker/internal/seccomp"
+	"golang.org/x/sys/unix"
 )
 
-const initEnv = "GOCKER_INIT"
+const (
+	initEnv      = "GOCKER_INIT"
+	containerEnv = "GOCKER_CONTAINER"
+
+	// syncFd is the file descriptor on which the init process waits until the parent
+	// has finished placing it in its cgroup. It is the first entry of cmd.ExtraFiles.
+	syncFd = 3
+
+	DefaultShmSize = int64(64 * 1024 * 1024)
+)
+
+// Config describes the container to run.
+// Entrypoint and Cmd are combined into the process arguments following Docker's rules, and the process runs
+// with the Env variables in WorkingDir as User, a user[:group] name or ID resolved in the container.
+// Volumes lists the container paths that get an anonymous volume mounted on them.
+// Devices lists the host devices made available inside the container and ShmSize
+// is the size in bytes of the tmpfs mounted on /dev/shm.
+// Capabilities is the capability set of the container process; Privileged lifts the default restrictions.
+// Seccomp is the system call filter applied to the container process, or nil to run unconfined,
+// and NoNewPrivileges stops the process from gaining privileges through setuid binaries or file capabilities.
+// ReadOnly makes the root filesystem read-only, with Tmpfs listing extra writable tmpfs mounts.
+// Rootfs is the root filesystem of Image, which the container changes through its own writable layer.
+// Layers are the root filesystems of the layers a build added on top of it, the topmost first.
+type Config struct {
+	Rootfs          string           `json:"rootfs"`
+	Layers          []string         `json:"layers,omitempty"`
+	Image           image.Stack      `json:"image"`
+	Entrypoint      []string         `json:"entrypoint,omitempty"`
+	Cmd             []string         `json:"cmd,omitempty"`
+	Env             []string         `json:"env,omitempty"`
+	WorkingDir      string           `json:"workingDir,omitempty"`
+	User            string           `json:"user,omitempty"`
+	Volumes         []string         `json:"volumes,omitempty"`
+	Devices         []Device         `json:"devices,omitempty"`
+	ShmSize         int64            `json:"shmSize"`
+	Capabilities    []string         `json:"capabilities"`
+	Privileged      bool             `json:"privileged,omitempty"`
+	Seccomp         *seccomp.Profile `json:"seccomp,omitempty"`
+	NoNewPrivileges bool             `json:"noNewPrivileges,omitempty"`
+	ReadOnly        bool             `json:"readOnly,omitempty"`
+	Tmpfs           []Tmpfs          `json:"tmpfs,omitempty"`
+}
 
 // Run initializes the container environment and starts the init process.
-// If the environment variable GOCKER_INIT is set to "1", it runs the init process
-// inside the container with the specified root filesystem and command.
-// If the environment variable is not set, it starts a new process with the same executable
-// and passes the environment variable to indicate that it is the init process.
-// It also attaches the process to a cgroup for resource management.
-func Run(rootfs string, command []string) error {
-	if os.Getenv(initEnv) == "1" {
-		return startInitProcess(rootfs, command)
+// It creates the container state and its anonymous volumes, then starts gocker init with the same executable
+// in new mount and IPC namespaces, passing the environment variables to indicate that it is the init process
+// of the container. It also attaches the process to a cgroup for resource management before letting it continue.
+func Run(cfg Config) error {
+	if cfg.ShmSize == 0 {
+		cfg.ShmSize = DefaultShmSize
+	}
+	if cfg.Capabilities == nil && !cfg.Privileged {
+		cfg.Capabilities = DefaultCapabilities
+	}
+
+	state, err := create(cfg)
+	if err != nil {
+		return err
 	}
+	fmt.Printf("Container ID: %s\n", state.ID)
+
+	syncReader, syncWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create sync pipe: %w", err)
+	}
+	defer syncWriter.Close()
 
 	cmd := exec.Command("/proc/self/exe")
-	cmd.Args = append([]string{"/proc/self/exe"}, os.Args[1:]...)
-	cmd.Env = append(os.Environ(), initEnv+"=1")
+	cmd.Args = []string{"/proc/self/exe", "init"}
+	cmd.Env = append(os.Environ(), initEnv+"=1", containerEnv+"="+state.ID)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{syncReader}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC}
 
-	err := cmd.Start()
+	err = cmd.Start()
+	syncReader.Close()
 	if err != nil {
 		return fmt.Errorf("failed to start container: %w", err)
 	}
 
-	err = attachToCgroup(uint64(cmd.Process.Pid))
+	state.Status = StatusRunning
+	state.Pid = cmd.Process.Pid
+	err = state.save()
+	if err != nil {
+		_ = cmd.Process.Kill()
+		return err
+	}
+
+	err = attachToCgroup(cmd.Process.Pid, state)
 	if err != nil {
 		_ = cmd.Process.Kill()
 		return fmt.Errorf("failed to apply cgroup: %w", err)
 	}
+	syncWriter.Close()
 
-	return cmd.Wait()
+	waitErr := cmd.Wait()
+
+	state.Status = StatusExited
+	state.Pid = 0
+	err = state.save()
+	if err != nil {
+		return err
+	}
+	return waitErr
 }
 
-// startInitProcess sets up the container environment by changing the root filesystem,
-// changing the working directory, mounting the proc filesystem, and executing the entrypoint script or command.
-// It is called when the GOCKER_INIT environment variable is set to "1".
-// It expects the root filesystem to be already set up and the command to be executed inside the container.
-// The entrypoint script is expected to be located at /usr/local/bin/docker-entrypoint.sh
-// If the script does not exist, it falls back to executing the first command in the command slice.
-// The command slice is expected to contain the command and its arguments to be executed inside the container
-func startInitProcess(rootfs string, command []string) error {
-	err := syscall.Chroot(rootfs)
+// Init runs the init process of the container gocker run started this process for, when the environment variable
+// GOCKER_INIT is set to "1". The configuration is the one the parent prepared and saved in the state referenced
+// in GOCKER_CONTAINER, so the init process does not build the root filesystem again.
+func Init() error {
+	if os.Getenv(initEnv) != "1" {
+		return fmt.Errorf("gocker init is only started by gocker run")
+	}
+	state, err := Load(os.Getenv(containerEnv))
+	if err != nil {
+		return err
+	}
+	return startInitProcess(state)
+}
+
+// startInitProcess sets up the container environment by waiting to be placed in its cgroup,
+// entering a new cgroup namespace, making the mounts private, mounting the writable layer over the image root filesystem,
+// mounting the standard pseudo-filesystems, devices and volumes,
+// changing the root filesystem, changing to the working directory, setting no_new_privs,
+// dropping the capabilities that were not granted from the bounding set, switching to the configured user,
+// setting the capabilities of the process, installing the seccomp filter
+// and executing the command.
+// It is called by Init.
+// It expects the root filesystem to be already set up.
+// The command is the entrypoint followed by the cmd of the configuration; its first element is looked up
+// in the PATH of the container environment when it is not a path.
+func startInitProcess(state *State) error {
+	// Namespaces entered with unshare belong to the calling thread only,
+	// so the rest of the init path must stay on it until exec.
+	runtime.LockOSThread()
+
+	args, err := state.Config.args()
+	if err != nil {
+		return err
+	}
+
+	err = waitForParent()
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Unshare(syscall.CLONE_NEWCGROUP)
+	if err != nil {
+		return fmt.Errorf("failed to create cgroup namespace: %w", err)
+	}
+
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	rootfs, err := mountWritableLayer(state)
+	if err != nil {
+		return err
+	}
+
+	err = setupRootfs(rootfs, state.Config, state.Mounts)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Chroot(rootfs)
 	if err != nil {
 		return fmt.Errorf("chroot failed: %w", err)
 	}
-	err = syscall.Chdir("/")
+
+	workingDir := state.Config.WorkingDir
+	if workingDir == "" {
+		workingDir = "/"
+	}
+	err = os.MkdirAll(workingDir, dirPerm)
+	if err != nil {
+		return fmt.Errorf("failed to create working directory %s: %w", workingDir, err)
+	}
+	err = syscall.Chdir(workingDir)
 	if err != nil {
 		return fmt.Errorf("chdir failed: %w", err)
 	}
-	err = syscall.Mount("proc", "/proc", "proc", 0, "")
+
+	user, err := resolveUser(state.Config.User)
 	if err != nil {
-		return fmt.Errorf("mount /proc failed: %w", err)
+		return err
 	}
+	env := environment(state.Config.Env, user.home)
 
-	entrypoint := command[0]
-	_, err = os.Stat(entrypoint) // Ensure the command exists
-	if os.IsNotExist(err) {
-		return fmt.Errorf("entrypoint command does not exist: %s", entrypoint)
+	entrypoint, err := lookPath(args[0], env)
+	if err != nil {
+		return fmt.Errorf("entrypoint command does not exist: %w", err)
 	}
-	command = command[1:]
 
 	fmt.Println("Running entrypoint:", entrypoint)
 
-	args := append([]string{entrypoint}, command...)
+	if state.Config.NoNewPrivileges {
+		err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %w", err)
+		}
+	}
+
+	// Loading a filter needs no_new_privs or CAP_SYS_ADMIN. With no_new_privs the filter is installed
+	// right before exec, so the setup system calls are not subject to it; without it, it must be installed
+	// before the capabilities and the user change, as runc does.
+	if state.Config.Seccomp != nil && !state.Config.NoNewPrivileges {
+		err = seccomp.Apply(state.Config.Seccomp, state.Config.Capabilities)
+		if err != nil {
+			return err
+		}
+	}
 
-	return syscall.Exec(entrypoint, args, os.Environ())
+	err = dropBoundingCapabilities(state.Config.Capabilities)
+	if err != nil {
+		return err
+	}
+
+	err = setUser(user)
+	if err != nil {
+		return err
+	}
+
+	err = applyCapabilities(state.Config.Capabilities, user.uid == 0)
+	if err != nil {
+		return err
+	}
+
+	if state.Config.Seccomp != nil && state.Config.NoNewPrivileges {
+		err = seccomp.Apply(state.Config.Seccomp, state.Config.Capabilities)
+		if err != nil {
+			return err
+		}
+	}
+
+	return syscall.Exec(entrypoint, args, env)
+}
+
+// waitForParent blocks until the parent closes its end of the sync pipe,
+// which happens once the process has been attached to its cgroup.
+func waitForParent() error {
+	pipe := os.NewFile(syncFd, "sync")
+	defer pipe.Close()
+
+	_, err := io.Copy(io.Discard, pipe)
+	if err != nil {
+		return fmt.Errorf("failed to wait for parent: %w", err)
+	}
+	return nil
 }
 
-// attachToCgroup attaches the current process to a cgroup with specified resource limits.
-// It creates a new cgroup with memory and CPU limits, adds the process to the cgroup,
+// attachToCgroup attaches the init process of a container to a cgroup of its own with specified resource limits.
+// It creates a systemd scope for the container holding the process, with memory and CPU limits,
+// then installs the device allowlist of the container as an eBPF program of the cgroup,
 // and returns an error if any operation fails.
-func attachToCgroup(pid uint64) error {
+func attachToCgroup(pid int, state *State) error {
 	maxMemory := int64(1024 * 1024 * 1024)
 	quota := int64(10000)
 	period := uint64(100000)
@@ -94,13 +285,14 @@ func attachToCgroup(pid uint64) error {
 		},
 	}
 
-	cg, err := cgroup2.NewSystemd("/", "gocker-container.slice", -1, &res)
+	cg, err := cgroup2.NewSystemd("", "gocker-"+state.ID+".scope", pid, &res)
 	if err != nil {
 		return fmt.Errorf("failed to create cgroup: %w", err)
 	}
 
-	if err := cg.AddProc(pid); err != nil {
-		return fmt.Errorf("failed to add process to cgroup: %w", err)
+	err = cg.Update(&cgroup2.Resources{Devices: deviceRules(state.Config)})
+	if err != nil {
+		return fmt.Errorf("failed to apply device rules: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,285 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/marcospedro/gocker/internal/filesystem"
+	"golang.org/x/sys/unix"
+)
+
+// CopyFrom copies the file or directory at srcPath of the container to dstPath on the host, like docker cp.
+// A relative srcPath is relative to the working directory of the container, and "dir/." copies the content
+// of a directory. With dstPath "-" the file or directory is written to w as a tar archive instead.
+// Paths of the container are resolved inside its root filesystem, and ownership, modes, times and extended
+// attributes are kept.
+func (s *State) CopyFrom(srcPath, dstPath string, w io.Writer) error {
+	src := s.containerPath(srcPath)
+	dst := dstPath
+	if dstPath != "-" {
+		var err error
+		dst, err = filepath.Abs(dstPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.withRootfs(func(root string) error {
+		info, err := filesystem.LstatPath(root, src)
+		if err != nil {
+			return fmt.Errorf("could not find %s in container %s: %w", srcPath, s.ID, err)
+		}
+		if dstPath == "-" {
+			return filesystem.WriteArchive(w, root, src, copyName(srcPath))
+		}
+
+		// The host side runs in other goroutines, as this one has the root filesystem of the container as its root.
+		var dir, as string
+		err = onHost(func() error {
+			var err error
+			dir, as, err = copyDestination("/", dst, strings.HasSuffix(dstPath, "/"), copyName(srcPath), info.IsDir())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		reader, writer := io.Pipe()
+		extracted := make(chan error, 1)
+		go func() {
+			err := filesystem.ExtractArchive(reader, "/", dir)
+			reader.CloseWithError(err)
+			extracted <- err
+		}()
+
+		err = filesystem.WriteArchive(writer, root, src, as)
+		writer.CloseWithError(err)
+		extractErr := <-extracted
+		if extractErr != nil {
+			return extractErr
+		}
+		return err
+	})
+}
+
+// CopyTo copies the file or directory at srcPath on the host into the container at dstPath, like docker cp.
+// A relative dstPath is relative to the working directory of the container, and "dir/." copies the content
+// of a directory. With srcPath "-" a tar archive read from r is extracted into the directory dstPath instead.
+// Paths of the container are resolved inside its root filesystem, so neither dstPath nor the archive can write
+// outside of it, and ownership, modes, times and extended attributes are kept.
+func (s *State) CopyTo(srcPath, dstPath string, r io.Reader) error {
+	dst := s.containerPath(dstPath)
+	if srcPath == "-" {
+		return s.withRootfs(func(root string) error {
+			hostDst, err := filesystem.ResolvePath(root, dst)
+			if err != nil {
+				return err
+			}
+			info, err := os.Stat(hostDst)
+			if err != nil || !info.IsDir() {
+				return fmt.Errorf("destination %s must be a directory of container %s", dstPath, s.ID)
+			}
+			return filesystem.ExtractArchive(r, root, dst)
+		})
+	}
+
+	src, err := filepath.Abs(srcPath)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	return s.withRootfs(func(root string) error {
+		dir, as, err := copyDestination(root, dst, strings.HasSuffix(dstPath, "/"), copyName(srcPath), info.IsDir())
+		if err != nil {
+			return err
+		}
+
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(filesystem.WriteArchive(writer, "/", src, as))
+		}()
+
+		err = filesystem.ExtractArchive(reader, root, dir)
+		reader.CloseWithError(err)
+		return err
+	})
+}
+
+// copyName returns the name a copy of a source path gets in a destination directory:
+// the base name of the path, or "." when its content is copied, as with "dir/.".
+func copyName(src string) string {
+	if src == "." || strings.HasSuffix(src, "/.") || path.Clean(src) == "/" {
+		return "."
+	}
+	return path.Base(filepath.ToSlash(src))
+}
+
+// copyDestination returns the directory of the root filesystem at root a copy is extracted into, and the name
+// of the copy in it, following docker cp: a copy into an existing directory is named as, a file replaces an existing
+// file, and a destination that does not exist yet is the new name of the copy, in a directory that must exist.
+// A destination ending with a slash, given by dstIsDir, must be a directory.
+func copyDestination(root, dst string, dstIsDir bool, as string, srcIsDir bool) (string, string, error) {
+	hostDst, err := filesystem.ResolvePath(root, dst)
+	if err != nil {
+		return "", "", err
+	}
+	info, err := os.Stat(hostDst)
+	switch {
+	case err == nil && info.IsDir():
+		return dst, as, nil
+	case err == nil:
+		if srcIsDir || dstIsDir {
+			return "", "", fmt.Errorf("cannot copy a directory to %s, which is not a directory", dst)
+		}
+		return path.Dir(dst), path.Base(dst), nil
+	case !os.IsNotExist(err):
+		return "", "", err
+	}
+
+	if dstIsDir && !srcIsDir {
+		return "", "", fmt.Errorf("destination directory %s does not exist", dst)
+	}
+	parent, err := filesystem.ResolvePath(root, path.Dir(dst))
+	if err != nil {
+		return "", "", err
+	}
+	info, err = os.Stat(parent)
+	if err != nil || !info.IsDir() {
+		return "", "", fmt.Errorf("destination directory %s does not exist", path.Dir(dst))
+	}
+	return path.Dir(dst), path.Base(dst), nil
+}
+
+// containerPath returns a path of the container as an absolute path, a relative one being relative to the working directory.
+func (s *State) containerPath(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join("/", s.Config.WorkingDir, p)
+}
+
+// withRootfs calls fn with the root filesystem of the container as the container sees it, the image root
+// filesystem with the writable layer and the volumes on top of it, made the root directory of the thread fn runs on,
+// so root is "/". Every path fn uses, absolute symlinks included, resolves inside the container as it does for the
+// processes of the container: a process swapping a directory for a symlink while the copy runs cannot make it read
+// or write a file of the host. The goroutines fn starts run on other threads and see the host.
+// A running container is entered through its mount namespace. For a stopped one, the writable layer and the volumes
+// are mounted with inMountNamespace.
+func (s *State) withRootfs(fn func(root string) error) error {
+	if s.Running() {
+		return inContainerRoot(s.Pid, func() error {
+			return fn("/")
+		})
+	}
+
+	return inMountNamespace(func() error {
+		root, err := mountWritableLayer(s)
+		if err == nil {
+			err = mountVolumes(root, s.Mounts)
+		}
+		if err == nil {
+			err = chrootThread(root)
+		}
+		if err != nil {
+			return err
+		}
+		return fn("/")
+	})
+}
+
+// inMountNamespace calls fn on a dedicated thread in a new mount namespace with private mounts:
+// only fn itself sees the mounts it makes, not the goroutines it starts, and they go away with the thread.
+func inMountNamespace(fn func() error) error {
+	return onDedicatedThread(func() error {
+		// A new mount namespace also gives the thread its own root and working directories.
+		err := syscall.Unshare(syscall.CLONE_NEWNS)
+		if err != nil {
+			return fmt.Errorf("failed to create mount namespace: %w", err)
+		}
+		err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+		if err != nil {
+			return fmt.Errorf("failed to make mounts private: %w", err)
+		}
+		return fn()
+	})
+}
+
+// inContainerRoot calls fn on a dedicated thread that joined the mount namespace of the process pid
+// and has its root directory, so fn sees the files of the container as its processes do.
+func inContainerRoot(pid int, fn func() error) error {
+	proc := filepath.Join("/proc", strconv.Itoa(pid))
+	return onDedicatedThread(func() error {
+		// The root is opened before joining the namespace, where the /proc of the host is out of reach.
+		root, err := os.Open(filepath.Join(proc, "root"))
+		if err != nil {
+			return err
+		}
+		defer root.Close()
+		ns, err := os.Open(filepath.Join(proc, "ns", "mnt"))
+		if err != nil {
+			return err
+		}
+		defer ns.Close()
+
+		// Joining a mount namespace needs a thread that shares its root and working directories with no other.
+		err = unix.Unshare(unix.CLONE_FS)
+		if err != nil {
+			return fmt.Errorf("failed to unshare filesystem attributes: %w", err)
+		}
+		err = unix.Setns(int(ns.Fd()), unix.CLONE_NEWNS)
+		if err != nil {
+			return fmt.Errorf("failed to join mount namespace of container process %d: %w", pid, err)
+		}
+		err = unix.Fchdir(int(root.Fd()))
+		if err == nil {
+			err = chrootThread(".")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to enter root filesystem of container process %d: %w", pid, err)
+		}
+		return fn()
+	})
+}
+
+// chrootThread makes dir the root directory of the calling thread, which must not share it with other threads,
+// and moves the thread into it.
+func chrootThread(dir string) error {
+	err := unix.Chroot(dir)
+	if err != nil {
+		return err
+	}
+	return unix.Chdir("/")
+}
+
+// onHost calls fn in another goroutine and waits for it. Called from fn of withRootfs, it runs fn on another
+// thread, which has the root directory of the host.
+func onHost(fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	return <-done
+}
+
+// onDedicatedThread calls fn on a thread of its own, which exits with it instead of serving other goroutines
+// with the namespaces and root directory fn may have changed.
+func onDedicatedThread(fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine instead of serving others.
+		runtime.LockOSThread()
+		done <- fn()
+	}()
+	return <-done
+}
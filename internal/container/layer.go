@@ -0,0 +1,104 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// The writable layer of a container is the upper directory of an overlayfs mount over the image root filesystem.
+// It lives in the container directory, so the changes outlive the container process until the container is removed.
+const (
+	upperDirName  = "upper"
+	workDirName   = "work"
+	mergedDirName = "rootfs"
+)
+
+// UpperDir returns the directory holding the changes the container made to the root filesystem of its image,
+// /tmp/gocker/containers/<id>/upper.
+func (s *State) UpperDir() string {
+	return filepath.Join(containersRoot, s.ID, upperDirName)
+}
+
+// MountPoints returns the container paths that get something mounted on them at run time: the default
+// pseudo-filesystems, the tmpfs mounts and the volumes. Creating them does not change the container.
+func (s *State) MountPoints() []string {
+	var paths []string
+	for _, entry := range defaultMounts(s.Config) {
+		paths = append(paths, entry.target)
+	}
+	for _, mount := range s.Config.Tmpfs {
+		paths = append(paths, filepath.Clean(mount.Path))
+	}
+	for _, mount := range s.Mounts {
+		paths = append(paths, filepath.Clean(mount.Destination))
+	}
+	return paths
+}
+
+// mountWritableLayer mounts the image root filesystem of the container with its writable layer on top
+// and returns the mount point, /tmp/gocker/containers/<id>/rootfs.
+// The image root filesystem and the layers of the build are the read-only lower directories, so containers
+// of the same image do not see each other's changes.
+func mountWritableLayer(state *State) (string, error) {
+	dir := filepath.Join(containersRoot, state.ID)
+	upper := filepath.Join(dir, upperDirName)
+	work := filepath.Join(dir, workDirName)
+	merged := filepath.Join(dir, mergedDirName)
+	for _, path := range []string{upper, work, merged} {
+		err := os.MkdirAll(path, dirPerm)
+		if err != nil {
+			return "", fmt.Errorf("failed to create writable layer: %w", err)
+		}
+	}
+
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		lowerDirs(state.Config), escapeOverlayPath(upper), escapeOverlayPath(work))
+	err := syscall.Mount("overlay", merged, "overlay", 0, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to mount writable layer: %w", err)
+	}
+	return merged, nil
+}
+
+// lowerDirs returns the lowerdir option of an overlayfs mount of the image root filesystem of a container:
+// the layers of the build, the topmost first, over the root filesystem of the base image.
+func lowerDirs(cfg Config) string {
+	var dirs []string
+	for _, dir := range append(cfg.Layers[:len(cfg.Layers):len(cfg.Layers)], cfg.Rootfs) {
+		dirs = append(dirs, escapeOverlayPath(dir))
+	}
+	return strings.Join(dirs, ":")
+}
+
+// WithImageRootfs calls fn with a read-only view of the root filesystem of the image of the container,
+// without its writable layer. Without build layers it is the root filesystem of the base image itself;
+// otherwise the layers are mounted over it in a new mount namespace, as withRootfs does.
+func (s *State) WithImageRootfs(fn func(root string) error) error {
+	if len(s.Config.Layers) == 0 {
+		return fn(s.Config.Rootfs)
+	}
+	return inMountNamespace(func() error {
+		dir, err := os.MkdirTemp("", "gocker-image-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(dir)
+
+		// An overlayfs mount without an upper directory is read-only.
+		err = syscall.Mount("overlay", dir, "overlay", syscall.MS_RDONLY, "lowerdir="+lowerDirs(s.Config))
+		if err != nil {
+			return fmt.Errorf("failed to mount image root filesystem: %w", err)
+		}
+		defer syscall.Unmount(dir, syscall.MNT_DETACH)
+		return fn(dir)
+	})
+}
+
+// escapeOverlayPath escapes the characters overlayfs uses to separate options and lower directories,
+// which appear in image paths such as /tmp/gocker/rootfs/localhost:5000/app.
+func escapeOverlayPath(path string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`, `,`, `\,`).Replace(path)
+}
@@ -0,0 +1,379 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/marcospedro/gocker/internal/filesystem"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Device describes a device node created inside the container.
+// HostPath is bind-mounted onto Path when the node cannot be created with mknod.
+type Device struct {
+	HostPath    string      `json:"hostPath"`
+	Path        string      `json:"path"`
+	Type        uint32      `json:"type"`
+	Major       uint32      `json:"major"`
+	Minor       uint32      `json:"minor"`
+	FileMode    os.FileMode `json:"fileMode"`
+	Permissions string      `json:"permissions"`
+}
+
+type mountEntry struct {
+	source string
+	target string
+	fstype string
+	flags  uintptr
+	data   string
+}
+
+// defaultDevices are the device nodes every OCI runtime provides in /dev.
+var defaultDevices = []Device{
+	{HostPath: "/dev/null", Path: "/dev/null", Type: syscall.S_IFCHR, Major: 1, Minor: 3, FileMode: 0o666},
+	{HostPath: "/dev/zero", Path: "/dev/zero", Type: syscall.S_IFCHR, Major: 1, Minor: 5, FileMode: 0o666},
+	{HostPath: "/dev/full", Path: "/dev/full", Type: syscall.S_IFCHR, Major: 1, Minor: 7, FileMode: 0o666},
+	{HostPath: "/dev/random", Path: "/dev/random", Type: syscall.S_IFCHR, Major: 1, Minor: 8, FileMode: 0o666},
+	{HostPath: "/dev/urandom", Path: "/dev/urandom", Type: syscall.S_IFCHR, Major: 1, Minor: 9, FileMode: 0o666},
+	{HostPath: "/dev/tty", Path: "/dev/tty", Type: syscall.S_IFCHR, Major: 5, Minor: 0, FileMode: 0o666},
+}
+
+// deviceTypes maps the file type of a device to its type in device cgroup rules.
+var deviceTypes = map[uint32]string{
+	syscall.S_IFCHR: "c",
+	syscall.S_IFBLK: "b",
+}
+
+// defaultSymlinks are the links runc creates in /dev, keyed by link path.
+var defaultSymlinks = map[string]string{
+	"/dev/fd":     "/proc/self/fd",
+	"/dev/stdin":  "/proc/self/fd/0",
+	"/dev/stdout": "/proc/self/fd/1",
+	"/dev/stderr": "/proc/self/fd/2",
+	"/dev/ptmx":   "pts/ptmx",
+}
+
+// defaultMounts returns the OCI default mount set, in the order the mounts must be applied.
+// The cgroup2 filesystem is mounted from within the container cgroup namespace, so it only exposes the container cgroup.
+// sysfs and cgroupfs are read-only unless the container is privileged.
+func defaultMounts(cfg Config) []mountEntry {
+	sysFlags := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV)
+	if !cfg.Privileged {
+		sysFlags |= syscall.MS_RDONLY
+	}
+
+	return []mountEntry{
+		{"proc", "/proc", "proc", syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV, ""},
+		{"tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID | syscall.MS_STRICTATIME, "mode=755,size=65536k"},
+		{"devpts", "/dev/pts", "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620,gid=5"},
+		{"shm", "/dev/shm", "tmpfs", syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV, fmt.Sprintf("mode=1777,size=%d", cfg.ShmSize)},
+		{"mqueue", "/dev/mqueue", "mqueue", syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV, ""},
+		{"sysfs", "/sys", "sysfs", sysFlags, ""},
+		{"cgroup", "/sys/fs/cgroup", "cgroup2", sysFlags | syscall.MS_RELATIME, ""},
+	}
+}
+
+// ParseDevice parses a --device specification in the Docker format host[:container[:permissions]].
+// The host path must be a character or block device; its type and numbers are read from the host.
+func ParseDevice(spec string) (Device, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return Device{}, fmt.Errorf("invalid device specification: %s", spec)
+	}
+
+	device := Device{HostPath: parts[0], Path: parts[0], Permissions: "rwm"}
+	if len(parts) > 1 && parts[1] != "" {
+		device.Path = parts[1]
+	}
+	if len(parts) > 2 {
+		device.Permissions = parts[2]
+	}
+
+	if !filepath.IsAbs(device.Path) {
+		return Device{}, fmt.Errorf("device path in container must be absolute: %s", device.Path)
+	}
+	if device.Permissions == "" || strings.Trim(device.Permissions, "rwm") != "" {
+		return Device{}, fmt.Errorf("invalid device permissions: %s", device.Permissions)
+	}
+
+	var stat syscall.Stat_t
+	err := syscall.Stat(device.HostPath, &stat)
+	if err != nil {
+		return Device{}, fmt.Errorf("failed to stat device %s: %w", device.HostPath, err)
+	}
+
+	device.Type = stat.Mode & syscall.S_IFMT
+	if device.Type != syscall.S_IFCHR && device.Type != syscall.S_IFBLK {
+		return Device{}, fmt.Errorf("%s is not a device", device.HostPath)
+	}
+	device.Major = unix.Major(stat.Rdev)
+	device.Minor = unix.Minor(stat.Rdev)
+	device.FileMode = os.FileMode(stat.Mode & 0o777)
+	return device, nil
+}
+
+// deviceRules returns the device cgroup rules of a container, an allowlist like Docker's: device nodes of any type
+// can be created, but only the default devices, the pseudo-terminals and the devices given with --device can be
+// read or written, the latter with the permissions they were given: /dev/ptmx is 5:2 and the pseudo-terminals are 136:*.
+// A privileged container gets every device
+// and no rules.
+func deviceRules(cfg Config) []specs.LinuxDeviceCgroup {
+	if cfg.Privileged {
+		return nil
+	}
+
+	rules := []specs.LinuxDeviceCgroup{
+		deviceRule(false, "a", -1, -1, "rwm"),
+		deviceRule(true, "c", -1, -1, "m"),
+		deviceRule(true, "b", -1, -1, "m"),
+		deviceRule(true, "c", 5, 2, "rwm"),
+		deviceRule(true, "c", 136, -1, "rwm"),
+	}
+	for _, device := range slices.Concat(defaultDevices, cfg.Devices) {
+		access := device.Permissions
+		if access == "" {
+			access = "rwm"
+		}
+		rules = append(rules, deviceRule(true, deviceTypes[device.Type], int64(device.Major), int64(device.Minor), access))
+	}
+	return rules
+}
+
+// deviceRule returns a device cgroup rule, type "a" and the numbers -1 matching any device.
+func deviceRule(allow bool, deviceType string, major, minor int64, access string) specs.LinuxDeviceCgroup {
+	return specs.LinuxDeviceCgroup{Allow: allow, Type: deviceType, Major: &major, Minor: &minor, Access: access}
+}
+
+// setupRootfs prepares the root filesystem before the chroot.
+// The mount propagation of the whole tree must already be private so nothing mounted
+// here leaks back to the host. The default pseudo-filesystems, device nodes,
+// /dev symlinks, tmpfs mounts and volumes are set up inside the root filesystem.
+// Unless the container is privileged the sensitive kernel paths are masked or made read-only,
+// and with ReadOnly the root filesystem itself is remounted read-only last.
+// Every mount point is resolved inside the root filesystem, so symlinks of the image cannot move mounts to the host.
+func setupRootfs(rootfs string, cfg Config, mounts []Mount) error {
+	for _, entry := range defaultMounts(cfg) {
+		err := mkdirInRoot(rootfs, entry.target)
+		if err != nil {
+			return fmt.Errorf("failed to create mount point %s: %w", entry.target, err)
+		}
+
+		err = inRoot(rootfs, entry.target, func(target string) error {
+			return syscall.Mount(entry.source, target, entry.fstype, entry.flags, entry.data)
+		})
+		if err != nil {
+			return fmt.Errorf("mount %s failed: %w", entry.target, err)
+		}
+	}
+
+	for _, device := range slices.Concat(defaultDevices, cfg.Devices) {
+		err := createDevice(rootfs, device)
+		if err != nil {
+			return err
+		}
+	}
+
+	for link, target := range defaultSymlinks {
+		err := inRoot(rootfs, filepath.Dir(link), func(dir string) error {
+			return os.Symlink(target, filepath.Join(dir, filepath.Base(link)))
+		})
+		if err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create symlink %s: %w", link, err)
+		}
+	}
+
+	err := mountTmpfs(rootfs, cfg)
+	if err != nil {
+		return err
+	}
+
+	err = mountVolumes(rootfs, mounts)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.Privileged {
+		err = maskPaths(rootfs)
+		if err != nil {
+			return err
+		}
+		err = makeReadonlyPaths(rootfs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.ReadOnly {
+		err = remountReadOnly(rootfs, "/")
+		if err != nil {
+			return fmt.Errorf("failed to make the root filesystem read-only: %w", err)
+		}
+	}
+	return nil
+}
+
+// createDevice creates the device node inside the root filesystem.
+// When mknod is not permitted, as in rootless mode, the host device is bind-mounted instead.
+func createDevice(rootfs string, device Device) error {
+	dir, name := filepath.Dir(device.Path), filepath.Base(device.Path)
+	err := mkdirInRoot(rootfs, dir)
+	if err != nil {
+		return fmt.Errorf("failed to create directory for device %s: %w", device.Path, err)
+	}
+
+	bind := false
+	err = inRoot(rootfs, dir, func(dir string) error {
+		target := filepath.Join(dir, name)
+		_ = os.Remove(target)
+		err := unix.Mknod(target, device.Type|uint32(device.FileMode), int(unix.Mkdev(device.Major, device.Minor)))
+		if err == nil {
+			return os.Chmod(target, device.FileMode)
+		}
+		if err != unix.EPERM {
+			return err
+		}
+
+		bind = true
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|syscall.O_NOFOLLOW, 0o644)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create device %s: %w", device.Path, err)
+	}
+
+	if !bind {
+		return nil
+	}
+	err = inRoot(rootfs, device.Path, func(target string) error {
+		return syscall.Mount(device.HostPath, target, "", syscall.MS_BIND, "")
+	})
+	if err != nil {
+		return fmt.Errorf("failed to bind mount device %s: %w", device.Path, err)
+	}
+	return nil
+}
+
+// mountVolumes bind-mounts every mount source onto its destination inside the root filesystem.
+// An empty gocker managed volume is first seeded with what the image has at its destination.
+func mountVolumes(rootfs string, mounts []Mount) error {
+	for _, mount := range mounts {
+		err := seedVolume(rootfs, mount)
+		if err != nil {
+			return err
+		}
+
+		err = mkdirInRoot(rootfs, mount.Destination)
+		if err != nil {
+			return fmt.Errorf("failed to create mount point %s: %w", mount.Destination, err)
+		}
+
+		err = inRoot(rootfs, mount.Destination, func(target string) error {
+			return syscall.Mount(mount.Source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		})
+		if err != nil {
+			return fmt.Errorf("failed to mount %s on %s: %w", mount.Source, mount.Destination, err)
+		}
+	}
+	return nil
+}
+
+// mkdirInRoot creates the directory name of the root filesystem at rootfs with its missing parents.
+// The path is resolved inside rootfs like a path of the container, so a symlink of the image cannot
+// make it create directories outside of rootfs.
+func mkdirInRoot(rootfs, name string) error {
+	hostPath, err := filesystem.ResolvePath(rootfs, name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(hostPath, dirPerm)
+}
+
+// inRoot calls fn with a path to the file name of the root filesystem at rootfs, resolved inside rootfs
+// like a path of the container. The path is /proc/self/fd/<n> of an O_PATH descriptor of the resolved file,
+// checked to be inside rootfs once opened, so neither a symlink of the image nor one swapped in after
+// the resolution can make fn mount on or create something outside of rootfs.
+func inRoot(rootfs, name string, fn func(path string) error) error {
+	hostPath, err := filesystem.ResolvePath(rootfs, name)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Open(hostPath, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: hostPath, Err: err}
+	}
+	defer unix.Close(fd)
+
+	fdPath := "/proc/self/fd/" + strconv.Itoa(fd)
+	opened, err := os.Readlink(fdPath)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(rootfs)
+	if err != nil {
+		return err
+	}
+	if opened != root && !strings.HasPrefix(opened, root+"/") {
+		return fmt.Errorf("%s resolves to %s, outside of the root filesystem", name, opened)
+	}
+	return fn(fdPath)
+}
+
+// seedVolume copies the content of the directory at the destination of a gocker managed volume into the volume
+// while the volume is still empty, along with the owner and mode of the directory, like Docker does for a new volume.
+// The content keeps its ownership, modes, times and extended attributes. Nothing is copied when the root filesystem
+// has no directory there.
+func seedVolume(rootfs string, mount Mount) error {
+	if mount.Volume == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(mount.Source)
+	if err != nil {
+		return fmt.Errorf("failed to read volume %s: %w", mount.Volume, err)
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+
+	hostPath, err := filesystem.ResolvePath(rootfs, mount.Destination)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(hostPath)
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", mount.Destination, err)
+	}
+	dir, err := filepath.Rel(rootfs, hostPath)
+	if err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(filesystem.WriteArchive(writer, rootfs, dir, "."))
+	}()
+	err = filesystem.ExtractArchive(reader, mount.Source, "/")
+	reader.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("failed to seed volume %s: %w", mount.Volume, err)
+	}
+
+	stat := info.Sys().(*syscall.Stat_t)
+	err = os.Lchown(mount.Source, int(stat.Uid), int(stat.Gid))
+	if err != nil {
+		return fmt.Errorf("failed to seed volume %s: %w", mount.Volume, err)
+	}
+	return os.Chmod(mount.Source, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
@@ -0,0 +1,80 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// defaultPath is the PATH of containers whose image does not set one, as in Docker.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// args combines the entrypoint and the command following Docker's rules:
+// the command is appended to the entrypoint as its arguments, or runs on its own without an entrypoint.
+func (c Config) args() ([]string, error) {
+	args := slices.Concat(c.Entrypoint, c.Cmd)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no command specified: the image and the Dockerfile set no ENTRYPOINT or CMD")
+	}
+	return args, nil
+}
+
+// environment returns the environment of the container process: the configured variables,
+// plus PATH and HOME when they are not set.
+func environment(env []string, home string) []string {
+	env = slices.Clone(env)
+	if !hasEnv(env, "PATH") {
+		env = append(env, "PATH="+defaultPath)
+	}
+	if !hasEnv(env, "HOME") {
+		env = append(env, "HOME="+home)
+	}
+	return env
+}
+
+func hasEnv(env []string, key string) bool {
+	return slices.ContainsFunc(env, func(pair string) bool {
+		k, _, _ := strings.Cut(pair, "=")
+		return k == key
+	})
+}
+
+// lookPath finds an executable in the PATH of the container environment. Names containing a slash are used as is.
+// It must run after chroot, so the container's own PATH directories are searched.
+func lookPath(name string, env []string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, checkExecutable(name)
+	}
+
+	path := defaultPath
+	for _, pair := range env {
+		if value, ok := strings.CutPrefix(pair, "PATH="); ok {
+			path = value
+		}
+	}
+
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		candidate := filepath.Join(dir, name)
+		if checkExecutable(candidate) == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("executable file not found in $PATH: %s", name)
+}
+
+// checkExecutable returns an error unless path is a file with an execute bit set.
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0o111 == 0 {
+		return fmt.Errorf("%s is not an executable file", path)
+	}
+	return nil
+}
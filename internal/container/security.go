@@ -0,0 +1,183 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// maskedPaths are hidden from unprivileged containers, as listed in the OCI runtime defaults.
+var maskedPaths = []string{
+	"/proc/asound",
+	"/proc/acpi",
+	"/proc/interrupts",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+	"/sys/devices/virtual/powercap",
+}
+
+// readonlyPaths are made read-only in unprivileged containers, as listed in the OCI runtime defaults.
+var readonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// readOnlyTmpfs are the writable tmpfs exceptions added to a read-only root filesystem.
+var readOnlyTmpfs = []string{"/tmp", "/var/tmp", "/run"}
+
+// Tmpfs is a tmpfs mounted in the container; Options uses the mount(8) syntax, e.g. rw,size=64m.
+type Tmpfs struct {
+	Path    string `json:"path"`
+	Options string `json:"options,omitempty"`
+}
+
+// ParseTmpfs parses a --tmpfs value in the Docker format path[:options].
+func ParseTmpfs(spec string) (Tmpfs, error) {
+	path, options, _ := strings.Cut(spec, ":")
+	if !filepath.IsAbs(path) {
+		return Tmpfs{}, fmt.Errorf("tmpfs path must be absolute: %s", path)
+	}
+
+	_, _, err := parseMountOptions(options)
+	if err != nil {
+		return Tmpfs{}, err
+	}
+	return Tmpfs{Path: filepath.Clean(path), Options: options}, nil
+}
+
+// parseMountOptions splits mount options into mount flags and filesystem specific data.
+// Options default to noexec,nosuid,nodev like Docker tmpfs mounts.
+func parseMountOptions(options string) (uintptr, string, error) {
+	flags := map[string]uintptr{
+		"ro":     syscall.MS_RDONLY,
+		"nosuid": syscall.MS_NOSUID,
+		"nodev":  syscall.MS_NODEV,
+		"noexec": syscall.MS_NOEXEC,
+	}
+	clears := map[string]uintptr{
+		"rw":   syscall.MS_RDONLY,
+		"suid": syscall.MS_NOSUID,
+		"dev":  syscall.MS_NODEV,
+		"exec": syscall.MS_NOEXEC,
+	}
+
+	mountFlags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	var data []string
+	for _, option := range strings.Split(options, ",") {
+		if option == "" {
+			continue
+		}
+		if flag, ok := flags[option]; ok {
+			mountFlags |= flag
+			continue
+		}
+		if flag, ok := clears[option]; ok {
+			mountFlags &^= flag
+			continue
+		}
+		if !strings.Contains(option, "=") {
+			return 0, "", fmt.Errorf("unsupported mount option: %s", option)
+		}
+		data = append(data, option)
+	}
+	return mountFlags, strings.Join(data, ","), nil
+}
+
+// mountTmpfs mounts every tmpfs of the configuration inside the root filesystem.
+// A read-only root filesystem gets the default writable exceptions unless they are configured explicitly.
+func mountTmpfs(rootfs string, cfg Config) error {
+	mounts := slices.Clone(cfg.Tmpfs)
+	if cfg.ReadOnly {
+		for _, path := range readOnlyTmpfs {
+			explicit := slices.ContainsFunc(mounts, func(t Tmpfs) bool { return t.Path == path })
+			if !explicit {
+				mounts = append(mounts, Tmpfs{Path: path, Options: "rw,nosuid,nodev,mode=1777"})
+			}
+		}
+	}
+
+	for _, tmpfs := range mounts {
+		flags, data, err := parseMountOptions(tmpfs.Options)
+		if err != nil {
+			return err
+		}
+
+		err = mkdirInRoot(rootfs, tmpfs.Path)
+		if err != nil {
+			return fmt.Errorf("failed to create mount point %s: %w", tmpfs.Path, err)
+		}
+
+		err = inRoot(rootfs, tmpfs.Path, func(target string) error {
+			return syscall.Mount("tmpfs", target, "tmpfs", flags, data)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to mount tmpfs on %s: %w", tmpfs.Path, err)
+		}
+	}
+	return nil
+}
+
+// maskPaths hides the masked paths: directories are covered with an empty read-only tmpfs
+// and files with a bind mount of /dev/null. Paths missing on this kernel are skipped.
+func maskPaths(rootfs string) error {
+	for _, path := range maskedPaths {
+		err := inRoot(rootfs, path, func(target string) error {
+			info, err := os.Stat(target)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_RDONLY, "")
+			}
+			return syscall.Mount("/dev/null", target, "", syscall.MS_BIND, "")
+		})
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mask %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// makeReadonlyPaths bind-mounts every read-only path onto itself and remounts it read-only.
+func makeReadonlyPaths(rootfs string) error {
+	for _, path := range readonlyPaths {
+		err := remountReadOnly(rootfs, path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to make %s read-only: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// remountReadOnly makes the path name of the root filesystem at rootfs a bind mount of itself and remounts it read-only.
+// Only the top mount becomes read-only; mounts below it keep their own flags. The path is opened again
+// for the remount, as the descriptor used for the bind mount still refers to the file below it.
+func remountReadOnly(rootfs, name string) error {
+	err := inRoot(rootfs, name, func(target string) error {
+		return syscall.Mount(target, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+	})
+	if err != nil {
+		return err
+	}
+	return inRoot(rootfs, name, func(target string) error {
+		return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+	})
+}
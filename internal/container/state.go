@@ -0,0 +1,224 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/marcospedro/gocker/internal/volume"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	containersRoot = "/tmp/gocker/containers"
+	stateFile      = "state.json"
+	dirPerm        = 0o755
+
+	StatusCreated = "created"
+	StatusRunning = "running"
+	StatusExited  = "exited"
+)
+
+// Mount describes a host directory bind-mounted into the container.
+// Volume is set when the source is a gocker managed volume.
+type Mount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Volume      string `json:"volume,omitempty"`
+}
+
+// State is the persisted description of a container.
+// Pid is the process ID of the init process while the container is running.
+type State struct {
+	ID     string  `json:"id"`
+	Config Config  `json:"config"`
+	Mounts []Mount `json:"mounts"`
+	Status string  `json:"status"`
+	Pid    int     `json:"pid,omitempty"`
+}
+
+// create allocates a new container ID, creates an anonymous volume for every
+// volume path of the configuration and persists the resulting state.
+func create(cfg Config) (*State, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate container id: %w", err)
+	}
+
+	state := &State{
+		ID:     hex.EncodeToString(buf),
+		Config: cfg,
+		Status: StatusCreated,
+	}
+
+	for _, path := range cfg.Volumes {
+		name, err := volume.Create()
+		if err != nil {
+			return nil, err
+		}
+		state.Mounts = append(state.Mounts, Mount{
+			Source:      volume.Path(name),
+			Destination: path,
+			Volume:      name,
+		})
+	}
+
+	err = os.MkdirAll(filepath.Join(containersRoot, state.ID), dirPerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container directory: %w", err)
+	}
+
+	return state, state.save()
+}
+
+// save writes the container state to /tmp/gocker/containers/<id>/state.json.
+func (s *State) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode container state: %w", err)
+	}
+
+	path := filepath.Join(containersRoot, s.ID, stateFile)
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write container state: %w", err)
+	}
+	return nil
+}
+
+// Load reads the state of the container identified by id.
+// Like Docker, any unique prefix of the ID is accepted.
+func Load(id string) (*State, error) {
+	fullID, err := resolveID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(containersRoot, fullID, stateFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container state: %w", err)
+	}
+
+	var state State
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode container state: %w", err)
+	}
+	return &state, nil
+}
+
+// List returns the state of every known container.
+func List() ([]*State, error) {
+	entries, err := os.ReadDir(containersRoot)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var states []*State
+	for _, entry := range entries {
+		state, err := Load(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// Remove deletes the container state. When removeVolumes is true the anonymous
+// volumes created for the container are removed as well, matching `docker rm -v`.
+func Remove(id string, removeVolumes bool) error {
+	state, err := Load(id)
+	if err != nil {
+		return err
+	}
+
+	if state.Running() {
+		return fmt.Errorf("container %s is running", state.ID)
+	}
+
+	if removeVolumes {
+		for _, mount := range state.Mounts {
+			if mount.Volume == "" {
+				continue
+			}
+			err := volume.Remove(mount.Volume)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = os.RemoveAll(filepath.Join(containersRoot, state.ID))
+	if err != nil {
+		return fmt.Errorf("failed to remove container %s: %w", state.ID, err)
+	}
+	return nil
+}
+
+// Running reports whether the init process of the container is alive. A container recorded as running
+// whose process is gone, because gocker was killed before it could record the exit, counts as stopped.
+func (s *State) Running() bool {
+	if s.Status != StatusRunning || s.Pid <= 0 {
+		return false
+	}
+	err := unix.Kill(s.Pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+// VolumesInUse returns the set of volume names referenced by any container.
+func VolumesInUse() (map[string]bool, error) {
+	states, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := map[string]bool{}
+	for _, state := range states {
+		for _, mount := range state.Mounts {
+			if mount.Volume != "" {
+				inUse[mount.Volume] = true
+			}
+		}
+	}
+	return inUse, nil
+}
+
+// resolveID expands a (possibly abbreviated) container ID to the full ID.
+func resolveID(id string) (string, error) {
+	if id == "" {
+		return "", fmt.Errorf("container id cannot be empty")
+	}
+
+	entries, err := os.ReadDir(containersRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var matches []string
+	for _, entry := range entries {
+		if entry.Name() == id {
+			return id, nil
+		}
+		if strings.HasPrefix(entry.Name(), id) {
+			matches = append(matches, entry.Name())
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no such container: %s", id)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("multiple containers match id %s", id)
+	}
+}
@@ -0,0 +1,148 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	passwdPath = "/etc/passwd"
+	groupPath  = "/etc/group"
+)
+
+// user is the identity the container process runs as.
+type user struct {
+	uid    int
+	gid    int
+	groups []int
+	home   string
+}
+
+// resolveUser resolves a Docker user specification, user[:group] with names or numeric IDs,
+// against the /etc/passwd and /etc/group of the container. It must run after chroot.
+// An empty specification is root. A numeric user missing from /etc/passwd is allowed, with group 0 and home /.
+func resolveUser(spec string) (user, error) {
+	u := user{home: "/"}
+	if spec == "" {
+		spec = "0"
+	}
+	name, group, hasGroup := strings.Cut(spec, ":")
+
+	passwd, err := readColonFile(passwdPath)
+	if err != nil {
+		return user{}, err
+	}
+	groups, err := readColonFile(groupPath)
+	if err != nil {
+		return user{}, err
+	}
+
+	uid, numeric := parseID(name)
+	found := false
+	for _, entry := range passwd {
+		if len(entry) < 7 || (numeric && entry[2] != name) || (!numeric && entry[0] != name) {
+			continue
+		}
+		u.uid, _ = parseID(entry[2])
+		u.gid, _ = parseID(entry[3])
+		u.home = entry[5]
+		name = entry[0]
+		found = true
+		break
+	}
+	if !found {
+		if !numeric {
+			return user{}, fmt.Errorf("unable to find user %s: no matching entries in passwd file", name)
+		}
+		u.uid = uid
+	}
+
+	if hasGroup {
+		gid, numeric := parseID(group)
+		if !numeric {
+			gid = -1
+			for _, entry := range groups {
+				if len(entry) >= 3 && entry[0] == group {
+					gid, _ = parseID(entry[2])
+					break
+				}
+			}
+			if gid < 0 {
+				return user{}, fmt.Errorf("unable to find group %s: no matching entries in group file", group)
+			}
+		}
+		u.gid = gid
+		return u, nil
+	}
+
+	// Without an explicit group, the process also gets the supplementary groups the user is a member of.
+	for _, entry := range groups {
+		if len(entry) < 4 {
+			continue
+		}
+		for _, member := range strings.Split(entry[3], ",") {
+			if member == name {
+				gid, _ := parseID(entry[2])
+				u.groups = append(u.groups, gid)
+			}
+		}
+	}
+	return u, nil
+}
+
+// setUser switches the process to the user. Capabilities are kept across the switch with PR_SET_KEEPCAPS
+// so applyCapabilities can still set them; they are cleared for non-root users there.
+func setUser(u user) error {
+	err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to keep capabilities: %w", err)
+	}
+
+	err = unix.Setgroups(u.groups)
+	if err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %w", err)
+	}
+	err = unix.Setresgid(u.gid, u.gid, u.gid)
+	if err != nil {
+		return fmt.Errorf("failed to set group %d: %w", u.gid, err)
+	}
+	err = unix.Setresuid(u.uid, u.uid, u.uid)
+	if err != nil {
+		return fmt.Errorf("failed to set user %d: %w", u.uid, err)
+	}
+	return nil
+}
+
+// readColonFile reads a colon separated file such as /etc/passwd. A missing file has no entries.
+func readColonFile(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
+
+// parseID parses a numeric user or group ID.
+func parseID(s string) (int, bool) {
+	id, err := strconv.Atoi(s)
+	return id, err == nil && id >= 0
+}
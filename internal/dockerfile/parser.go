@@ -2,17 +2,21 @@ package dockerfile
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"unicode"
 )
 
 // Instruction represents a parsed Dockerfile instruction.
 type Instruction interface{}
 
+// FromInstruction holds the image reference as written in the Dockerfile, e.g. node:alpine or ghcr.io/org/app:1.2.
+// Platform is the value of the optional --platform flag, e.g. linux/arm64.
 type FromInstruction struct {
-	Image string
-	Tag   string
+	Image    string
+	Platform string
 }
 
 type CopyInstruction struct {
@@ -20,13 +24,51 @@ type CopyInstruction struct {
 	Dst string
 }
 
+// EntryPointInstruction and CmdInstruction hold the command in exec form;
+// the shell form is stored as ["/bin/sh", "-c", "<command>"] like Docker does.
 type EntryPointInstruction struct {
 	Entrypoint []string
 }
 
+type CmdInstruction struct {
+	Cmd []string
+}
+
+// EnvInstruction holds the variables of an ENV instruction in order, as KEY=value pairs.
+type EnvInstruction struct {
+	Env []string
+}
+
+type WorkdirInstruction struct {
+	Path string
+}
+
+// UserInstruction holds the user, and optionally the group, as a name or a numeric ID, e.g. node or 1000:1000.
+type UserInstruction struct {
+	User string
+}
+
+type VolumeInstruction struct {
+	Paths []string
+}
+
+// lookup maps every supported instruction keyword to the function parsing it.
+// Each function receives the rest of the line after the keyword as it is written, so whitespace
+// inside JSON arrays, shell commands and ENV values is kept.
+var lookup = map[string]func(string) (Instruction, error){
+	"FROM":       parseFrom,
+	"COPY":       parseCopy,
+	"ENTRYPOINT": parseEntrypoint,
+	"CMD":        parseCmd,
+	"ENV":        parseEnv,
+	"WORKDIR":    parseWorkdir,
+	"USER":       parseUser,
+	"VOLUME":     parseVolume,
+}
+
 // Parse parses a Dockerfile and returns a slice of instructions.
 // It reads the Dockerfile line by line, ignoring comments and empty lines,
-// and uses a lookup map to call the appropriate parsing function for each instruction.
+// and parses every other line with ParseLine.
 func Parse(path string) ([]Instruction, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -37,27 +79,15 @@ func Parse(path string) ([]Instruction, error) {
 	scanner := bufio.NewScanner(file)
 	var instructions []Instruction
 
-	lookup := map[string]func([]string) (Instruction, error){
-		"FROM":       parseFrom,
-		"COPY":       parseCopy,
-		"ENTRYPOINT": parseEntrypoint,
-	}
-
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 
-		parts := strings.Fields(line)
-		parseFn, ok := lookup[parts[0]]
-		if !ok {
-			return nil, fmt.Errorf("unknown instruction: %s", parts[0])
-		}
-
-		instruction, err := parseFn(parts)
+		instruction, err := ParseLine(line)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing instruction '%s': %w", line, err)
+			return nil, err
 		}
 		instructions = append(instructions, instruction)
 	}
@@ -69,34 +99,199 @@ func Parse(path string) ([]Instruction, error) {
 	return instructions, nil
 }
 
-func parseFrom(parts []string) (Instruction, error) {
-	if len(parts) != 2 {
+// ParseLine parses a single instruction, such as a --change of gocker commit, e.g. `ENV DEBUG=1`.
+// It uses the lookup map to call the appropriate parsing function for the instruction.
+func ParseLine(line string) (Instruction, error) {
+	line = strings.TrimSpace(line)
+	keyword, args := cutWord(line)
+	if keyword == "" {
+		return nil, fmt.Errorf("empty instruction")
+	}
+
+	parseFn, ok := lookup[keyword]
+	if !ok {
+		return nil, fmt.Errorf("unknown instruction: %s", keyword)
+	}
+
+	instruction, err := parseFn(args)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing instruction '%s': %w", line, err)
+	}
+	return instruction, nil
+}
+
+// cutWord splits s at its first run of whitespace into the first word and the rest, trimmed.
+func cutWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+func parseFrom(args string) (Instruction, error) {
+	var from FromInstruction
+	parts := strings.Fields(args)
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "--platform=") {
+		from.Platform = strings.TrimPrefix(parts[0], "--platform=")
+		parts = parts[1:]
+		if from.Platform == "" {
+			return nil, fmt.Errorf("invalid FROM instruction: empty --platform")
+		}
+	}
+
+	if len(parts) != 1 || strings.HasPrefix(parts[0], "-") {
 		return nil, fmt.Errorf("invalid FROM instruction")
 	}
-	image := strings.Split(parts[1], ":")
-	return FromInstruction{Image: image[0], Tag: image[1]}, nil
+	from.Image = parts[0]
+	return from, nil
 }
 
-func parseCopy(parts []string) (Instruction, error) {
-	if len(parts) != 3 {
+func parseCopy(args string) (Instruction, error) {
+	parts := strings.Fields(args)
+	if len(parts) != 2 {
 		return nil, fmt.Errorf("invalid COPY instruction")
 	}
-	return CopyInstruction{Src: parts[1], Dst: parts[2]}, nil
+	return CopyInstruction{Src: parts[0], Dst: parts[1]}, nil
 }
 
-func parseEntrypoint(parts []string) (Instruction, error) {
-	parts = parts[1:]
+func parseEntrypoint(args string) (Instruction, error) {
+	return EntryPointInstruction{Entrypoint: parseCommand(args)}, nil
+}
 
-	entrypoint := []string{}
+func parseCmd(args string) (Instruction, error) {
+	return CmdInstruction{Cmd: parseCommand(args)}, nil
+}
 
-	for _, part := range parts {
-		part = strings.Trim(part, `"'[],`)
-		if part == "" {
-			continue
+// parseCommand accepts the exec form (["node", "index.js"]) and the shell form (node index.js).
+// Arguments that are not a valid JSON array of strings are the shell form, as in Docker.
+func parseCommand(args string) []string {
+	if args == "" {
+		return []string{}
+	}
+
+	if strings.HasPrefix(args, "[") {
+		var command []string
+		err := json.Unmarshal([]byte(args), &command)
+		if err == nil {
+			return command
+		}
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+// parseEnv accepts the KEY=value form, with several pairs and quoted values (ENV A=1 B="two words"),
+// and the legacy form setting a single variable to the rest of the line (ENV KEY some value).
+func parseEnv(args string) (Instruction, error) {
+	key, value := cutWord(args)
+	if key == "" {
+		return nil, fmt.Errorf("invalid ENV instruction")
+	}
+
+	if !strings.Contains(key, "=") {
+		if value == "" {
+			return nil, fmt.Errorf("ENV %s is missing a value", key)
+		}
+		return EnvInstruction{Env: []string{key + "=" + value}}, nil
+	}
+
+	words, err := splitWords(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	for _, word := range words {
+		key, _, ok := strings.Cut(word, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid ENV pair %q, expected KEY=value", word)
+		}
+		env = append(env, word)
+	}
+	return EnvInstruction{Env: env}, nil
+}
+
+// splitWords splits a line on spaces, keeping quoted text together and removing the quotes and escapes.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(runes):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
 		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func parseWorkdir(args string) (Instruction, error) {
+	if args == "" {
+		return nil, fmt.Errorf("invalid WORKDIR instruction")
+	}
+	return WorkdirInstruction{Path: args}, nil
+}
+
+func parseUser(args string) (Instruction, error) {
+	parts := strings.Fields(args)
+	if len(parts) != 1 {
+		return nil, fmt.Errorf("invalid USER instruction")
+	}
+	return UserInstruction{User: parts[0]}, nil
+}
 
-		entrypoint = append(entrypoint, part)
+// parseVolume accepts both the JSON form (VOLUME ["/data", "/logs"])
+// and the plain form (VOLUME /data /logs).
+func parseVolume(args string) (Instruction, error) {
+	if args == "" {
+		return nil, fmt.Errorf("invalid VOLUME instruction")
+	}
+
+	var paths []string
+	if strings.HasPrefix(args, "[") {
+		err := json.Unmarshal([]byte(args), &paths)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VOLUME JSON array: %w", err)
+		}
+	} else {
+		paths = strings.Fields(args)
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			return nil, fmt.Errorf("VOLUME path cannot be empty")
+		}
 	}
 
-	return EntryPointInstruction{Entrypoint: entrypoint}, nil
+	return VolumeInstruction{Paths: paths}, nil
 }
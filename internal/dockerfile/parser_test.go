@@ -0,0 +1,62 @@
+package dockerfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want Instruction
+	}{
+		{`FROM --platform=linux/arm64 node:alpine`, FromInstruction{Image: "node:alpine", Platform: "linux/arm64"}},
+		{`COPY  app.js   /app/`, CopyInstruction{Src: "app.js", Dst: "/app/"}},
+		{`CMD ["echo", "a  b", "c\td"]`, CmdInstruction{Cmd: []string{"echo", "a  b", "c\td"}}},
+		{`ENTRYPOINT ["printf",  "%s\n"]`, EntryPointInstruction{Entrypoint: []string{"printf", "%s\n"}}},
+		{`CMD echo "a  b"`, CmdInstruction{Cmd: []string{"/bin/sh", "-c", `echo "a  b"`}}},
+		{`CMD [not json`, CmdInstruction{Cmd: []string{"/bin/sh", "-c", "[not json"}}},
+		{`CMD`, CmdInstruction{Cmd: []string{}}},
+		{`ENV A=1 B="two  words" C=x\ y`, EnvInstruction{Env: []string{"A=1", "B=two  words", "C=x y"}}},
+		{`ENV LEGACY some   value`, EnvInstruction{Env: []string{"LEGACY=some   value"}}},
+		{"ENV\tTAB=1", EnvInstruction{Env: []string{"TAB=1"}}},
+		{`WORKDIR /my  app`, WorkdirInstruction{Path: "/my  app"}},
+		{`USER node:node`, UserInstruction{User: "node:node"}},
+		{`VOLUME ["/data", "/my  logs"]`, VolumeInstruction{Paths: []string{"/data", "/my  logs"}}},
+		{`VOLUME /data  /logs`, VolumeInstruction{Paths: []string{"/data", "/logs"}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseLine(tt.line)
+		if err != nil {
+			t.Errorf("ParseLine(%q) failed: %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseLine(%q) = %#v, want %#v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	lines := []string{
+		``,
+		`RUN make`,
+		`FROM`,
+		`FROM --platform= node`,
+		`COPY onlysource`,
+		`ENV`,
+		`ENV KEY`,
+		`ENV =value`,
+		`ENV A="unterminated`,
+		`WORKDIR`,
+		`USER a b`,
+		`VOLUME ["/data"`,
+		`VOLUME [""]`,
+	}
+	for _, line := range lines {
+		_, err := ParseLine(line)
+		if err == nil {
+			t.Errorf("ParseLine(%q) succeeded, want an error", line)
+		}
+	}
+}
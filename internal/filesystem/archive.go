@@ -0,0 +1,73 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ResolvePath returns the host path of a path of the root filesystem at root, with every symlink,
+// the last component included, resolved inside root as if root were /.
+func ResolvePath(root, name string) (string, error) {
+	return resolveInRoot(root, name)
+}
+
+// WriteArchive writes the file or directory at name of the root filesystem at root to w as an uncompressed tar,
+// for gocker cp. The parent directories of name are resolved inside root while the last component is not
+// followed, so a symlink is archived as a symlink. The entries are named after as: the file itself is as and
+// the content of a directory goes below it, or at the top of the archive when as is ".".
+// Ownership, modes, times, extended attributes and hard links are kept as in a layer.
+func WriteArchive(w io.Writer, root, name, as string) error {
+	hostPath, err := securePath(root, name)
+	if err != nil {
+		return err
+	}
+
+	lw := &layerWriter{tw: tar.NewWriter(w), root: root, written: map[string]bool{}, inodes: map[fileID]string{}}
+	err = filepath.WalkDir(hostPath, func(entryPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		entryName := path.Join(as, filepath.ToSlash(mustRel(hostPath, entryPath)))
+		if entryName == "." {
+			return nil
+		}
+		return lw.writeFile(entryName, entryPath)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", name, err)
+	}
+	return lw.tw.Close()
+}
+
+// ExtractArchive extracts an uncompressed tar read from r into the directory dir of the root filesystem at root,
+// for gocker cp. Entries are resolved inside root like the entries of a layer and keep their ownership, modes,
+// times and extended attributes, but they cannot climb out of dir and whiteout files are extracted as they are.
+func ExtractArchive(r io.Reader, root, dir string) error {
+	dir = path.Clean("/" + filepath.ToSlash(dir))
+	options := extractOptions{dir: strings.TrimPrefix(dir, "/")}
+	if options.dir == "" {
+		options.dir = "."
+	}
+
+	err := handleTarHeader(tar.NewReader(r), root, options)
+	if err != nil {
+		return fmt.Errorf("failed to extract archive into %s: %w", dir, err)
+	}
+	return nil
+}
+
+// LstatPath returns the FileInfo of a path of the root filesystem at root, resolving its parent directories
+// inside root without following the last component.
+func LstatPath(root, name string) (os.FileInfo, error) {
+	hostPath, err := securePath(root, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(hostPath)
+}
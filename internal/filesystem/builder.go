@@ -2,45 +2,36 @@ package filesystem
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-)
+	"path"
+	"strings"
 
-const (
-	layerFileExt = ".gz"
-	dirPerm      = 0o755
+	"github.com/marcospedro/gocker/internal/image"
 )
 
-// BuildFromLayers extracts all layer archives (*.gz) from a directory and builds the root filesystem at targetRoot.
+const dirPerm = 0o755
+
+// BuildFromLayers extracts the layer archives stored in layersDir and builds the root filesystem at targetRoot.
+// The layers are applied in the order of the list, the order of the image manifest, from the bottom layer.
 // This function is the only one that orchestrates the others: extraction, decompression, untar and file writing.
-func BuildFromLayers(layersDir, targetRoot string) error {
-	files, err := os.ReadDir(layersDir)
-	if err != nil {
-		return err
-	}
+// When a layer fails to extract, the partially built root filesystem is removed.
+func BuildFromLayers(layersDir string, layers []image.Layer, targetRoot string) error {
+	for _, layer := range layers {
+		layerPath := image.LayerPath(layersDir, layer)
 
-	for _, file := range files {
-		if filepath.Ext(file.Name()) != layerFileExt {
-			continue
+		err := extractLayer(layerPath, layer.MediaType, targetRoot)
+		if err != nil {
+			_ = os.RemoveAll(targetRoot)
+			return fmt.Errorf("failed to extract layer %s: %w", layer.Digest, err)
 		}
-
-		layerPath := filepath.Join(layersDir, file.Name())
-
-		extractLayer(layerPath, targetRoot)
 	}
 	return nil
 }
 
-// extractLayer extracts a single layer from a gzipped tar archive.
-// It opens the layer file, creates a gzip reader, and then a tar reader to process
-// the contents of the tar archive. It handles different types of entries in the tar file
-// such as directories, regular files, symlinks, and hard links.
-// The extracted files are written to the targetRoot directory, maintaining the original structure.
-// It returns an error if any operation fails, such as opening the file, creating readers,
-func extractLayer(layerPath, targetRoot string) error {
+// extractLayer extracts a single layer file into targetRoot with ApplyLayer.
+func extractLayer(layerPath, mediaType, targetRoot string) error {
 	fmt.Printf("Extracting layer %s...\n", layerPath)
 
 	file, err := os.Open(layerPath)
@@ -49,34 +40,67 @@ func extractLayer(layerPath, targetRoot string) error {
 	}
 	defer file.Close()
 
-	gzipReader, err := gzip.NewReader(file)
+	err = ApplyLayer(file, mediaType, targetRoot)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Layer %s extracted successfully.\n", layerPath)
+	return nil
+}
+
+// ApplyLayer applies a layer read from r, a tar archive compressed with gzip or zstd or not at all, to the
+// root filesystem at targetRoot. It creates a decompressing reader, and then a tar reader to process
+// the contents of the tar archive, handling every type of entry such as directories, regular files,
+// symlinks, and hard links, and the whiteouts deleting content of the lower layers.
+// The extracted files are written to the targetRoot directory, maintaining the original structure.
+// r may be a layer still downloading; nothing is printed, so it does not disturb a progress display.
+func ApplyLayer(r io.Reader, mediaType, targetRoot string) error {
+	layerReader, err := decompress(r, mediaType)
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+		return err
 	}
-	defer gzipReader.Close()
+	defer layerReader.Close()
 
-	tarReader := tar.NewReader(gzipReader)
+	tarReader := tar.NewReader(layerReader)
 
-	err = handleTarHeader(tarReader, targetRoot)
+	err = handleTarHeader(tarReader, targetRoot, extractOptions{whiteouts: true})
 
 	if err != nil {
 		return fmt.Errorf("failed to handle tar header: %w", err)
 	}
-
-	fmt.Printf("Layer %s extracted successfully.\n", layerPath)
 	return nil
 }
 
+// extractOptions tells handleTarHeader how to extract an archive: the entries of a layer are relative to
+// the root filesystem and apply their whiteouts, while those of gocker cp are extracted below dir and
+// whiteout files are ordinary files there.
+type extractOptions struct {
+	dir       string
+	whiteouts bool
+}
+
 // handleTarHeader processes each entry in the tar archive.
 // It uses a map of handlers to call the appropriate function based on the type of entry.
-// The handlers are responsible for creating directories, writing regular files, creating symlinks, and handling hard links.
-func handleTarHeader(tarReader *tar.Reader, targetRoot string) error {
+// The handlers are responsible for creating directories, writing regular and sparse files, creating symlinks,
+// hard links, device nodes and FIFOs. Long names and PAX attributes are resolved by the tar reader,
+// and PAX global headers carry nothing to extract.
+// Every entry gets the ownership, mode, extended attributes and times of its header; directories get their
+// times last, once their content is written. Whiteout markers are not extracted but applied to what the lower layers left in targetRoot.
+func handleTarHeader(tarReader *tar.Reader, targetRoot string, options extractOptions) error {
 	handlers := map[byte]func(*tar.Header, io.Reader, string) error{
-		tar.TypeDir:     handleDir,
-		tar.TypeReg:     handleReg,
-		tar.TypeSymlink: handleSymlink,
-		tar.TypeLink:    handleLink,
+		tar.TypeDir:       handleDir,
+		tar.TypeReg:       handleReg,
+		tar.TypeSymlink:   handleSymlink,
+		tar.TypeLink:      handleLink,
+		tar.TypeCont:      handleReg,
+		tar.TypeGNUSparse: handleSparse,
+		tar.TypeChar:      handleDevice,
+		tar.TypeBlock:     handleDevice,
+		tar.TypeFifo:      handleFifo,
 	}
+	extracted := map[string]bool{}
+	var dirs []*tar.Header
 
 	for {
 		header, err := tarReader.Next()
@@ -87,16 +111,113 @@ func handleTarHeader(tarReader *tar.Reader, targetRoot string) error {
 			return fmt.Errorf("failed to read tar entry: %w", err)
 		}
 
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if options.dir != "" {
+			name, err = rebaseEntry(header, name, options.dir)
+			if err != nil {
+				return err
+			}
+		}
+		if options.whiteouts && isWhiteout(name) {
+			err := applyWhiteout(name, targetRoot, extracted)
+			if err != nil {
+				return fmt.Errorf("failed to apply whiteout %s: %w", header.Name, err)
+			}
+			continue
+		}
+		markExtracted(name, extracted)
+
 		handler, ok := handlers[header.Typeflag]
 		if !ok {
 			return fmt.Errorf("unknown tar entry type: %c", header.Typeflag)
 		}
 
+		// An entry of a layer replaces a lower directory along with its content, but gocker cp refuses to,
+		// like docker cp, rather than delete a directory of the container.
+		if !options.whiteouts && header.Typeflag != tar.TypeDir {
+			err := checkNotDirectory(targetRoot, header.Name)
+			if err != nil {
+				return err
+			}
+		}
+
 		err = handler(header, tarReader, targetRoot)
+		if err == errSkipped {
+			continue
+		}
 		if err != nil {
 			return fmt.Errorf("failed to handle tar entry %s: %w", header.Name, err)
 		}
+
+		// Hard links share the metadata of the file they point to.
+		if header.Typeflag == tar.TypeLink {
+			continue
+		}
+		target, err := securePath(targetRoot, header.Name)
+		if err != nil {
+			return err
+		}
+		err = applyMetadata(header, target)
+		if err != nil {
+			return fmt.Errorf("failed to apply metadata of %s: %w", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, header)
+		}
+	}
+
+	// A later entry may have replaced a directory with another kind of file, a symlink most dangerously,
+	// whose target must not get the mode of the directory.
+	for _, dir := range dirs {
+		target, err := securePath(targetRoot, dir.Name)
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = applyModeAndTimes(dir, target)
+		if err != nil {
+			return fmt.Errorf("failed to apply metadata of %s: %w", dir.Name, err)
+		}
 	}
+	return nil
+}
 
+// checkNotDirectory returns an error when name of the root filesystem at root is an existing directory.
+func checkNotDirectory(root, name string) error {
+	target, err := securePath(root, name)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(target)
+	if err == nil && info.IsDir() {
+		return fmt.Errorf("cannot overwrite directory %s with a non-directory", name)
+	}
 	return nil
 }
+
+// rebaseEntry moves a tar entry, and the target of a hard link, below dir of the root filesystem.
+// Names climbing out of dir with ".." are rejected, as the archive is only meant to write into dir.
+func rebaseEntry(header *tar.Header, name, dir string) (string, error) {
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("path %q escapes the destination directory", header.Name)
+	}
+	header.Name = path.Join(dir, name)
+	if header.Typeflag == tar.TypeLink {
+		link := path.Clean(strings.TrimPrefix(header.Linkname, "/"))
+		if link == ".." || strings.HasPrefix(link, "../") {
+			return "", fmt.Errorf("link target %q escapes the destination directory", header.Linkname)
+		}
+		header.Linkname = path.Join(dir, link)
+	}
+	return path.Clean(strings.TrimPrefix(header.Name, "/")), nil
+}
@@ -0,0 +1,413 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const tarMediaType = "application/vnd.oci.image.layer.v1.tar"
+
+// modTime is the modification time of every test entry, so the tree can check that it is kept.
+var modTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// testEntry is an entry of a test layer: its header and, for regular files, its content.
+type testEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+func dir(name string, mode int64) testEntry {
+	return testEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: mode}}
+}
+
+func file(name string, mode int64, body string) testEntry {
+	return testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode, Size: int64(len(body))}, body: body}
+}
+
+func symlink(name, target string) testEntry {
+	return testEntry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0o777}}
+}
+
+func hardlink(name, target string) testEntry {
+	return testEntry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: target}}
+}
+
+func owned(e testEntry, uid, gid int) testEntry {
+	e.hdr.Uid, e.hdr.Gid = uid, gid
+	return e
+}
+
+// buildLayer writes the entries as an uncompressed tar in memory, in their order.
+func buildLayer(t testing.TB, entries ...testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.ModTime = modTime
+		hdr.Format = tar.FormatPAX
+		err := tw.WriteHeader(&hdr)
+		if err == nil {
+			_, err = tw.Write([]byte(e.body))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// applyLayers applies uncompressed layers in order to a new root filesystem and returns it.
+func applyLayers(t *testing.T, layers ...[]byte) string {
+	t.Helper()
+	root := t.TempDir()
+	for i, layer := range layers {
+		err := ApplyLayer(bytes.NewReader(layer), tarMediaType, root)
+		if err != nil {
+			t.Fatalf("layer %d: %v", i, err)
+		}
+	}
+	return root
+}
+
+// describeTree describes every entry below root by its relative name: its type, permissions and content or target,
+// with its owner when withOwners is set. Hard links share the description of their first name.
+func describeTree(t *testing.T, root string, withOwners bool) map[string]string {
+	t.Helper()
+	tree := map[string]string{}
+	inodes := map[uint64]string{}
+	err := filepath.WalkDir(root, func(hostPath string, _ fs.DirEntry, err error) error {
+		if err != nil || hostPath == root {
+			return err
+		}
+		name := mustRel(root, hostPath)
+		var st unix.Stat_t
+		err = unix.Lstat(hostPath, &st)
+		if err != nil {
+			return err
+		}
+		if first, ok := inodes[st.Ino]; ok && st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			tree[name] = "link to " + first
+			return nil
+		}
+		inodes[st.Ino] = name
+
+		var desc string
+		switch st.Mode & unix.S_IFMT {
+		case unix.S_IFDIR:
+			desc = fmt.Sprintf("dir %04o", st.Mode&0o7777)
+		case unix.S_IFREG:
+			data, err := os.ReadFile(hostPath)
+			if err != nil {
+				return err
+			}
+			desc = fmt.Sprintf("file %04o %q", st.Mode&0o7777, data)
+		case unix.S_IFLNK:
+			target, err := os.Readlink(hostPath)
+			if err != nil {
+				return err
+			}
+			desc = "symlink " + target
+		default:
+			desc = fmt.Sprintf("special %o", st.Mode)
+		}
+		if withOwners {
+			desc += fmt.Sprintf(" %d:%d", st.Uid, st.Gid)
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFLNK && time.Unix(st.Mtim.Unix()).UTC() != modTime {
+			desc += " mtime " + time.Unix(st.Mtim.Unix()).UTC().String()
+		}
+		tree[name] = desc
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func checkTree(t *testing.T, root string, withOwners bool, want map[string]string) {
+	t.Helper()
+	got := describeTree(t, root, withOwners)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tree mismatch\ngot:  %v\nwant: %v", got, want)
+	}
+}
+
+func TestApplyLayerWhiteouts(t *testing.T) {
+	base := buildLayer(t,
+		dir("etc", 0o755),
+		file("etc/deleted", 0o644, "old"),
+		file("etc/kept", 0o644, "kept"),
+		dir("etc/removed", 0o755),
+		file("etc/removed/file", 0o644, "gone"),
+		dir("opt", 0o755),
+		file("opt/lower", 0o644, "lower"),
+		dir("opt/sub", 0o755),
+		file("opt/sub/lower", 0o644, "lower"),
+	)
+	top := buildLayer(t,
+		dir("etc", 0o755),
+		file("etc/.wh.deleted", 0o644, ""),
+		file("etc/.wh.removed", 0o644, ""),
+		file("etc/.wh..wh.plnk", 0o644, ""),
+		// An entry of the layer written before the opaque marker of its directory survives it.
+		dir("opt", 0o755),
+		file("opt/before", 0o644, "before"),
+		file("opt/.wh..wh..opq", 0o644, ""),
+		file("opt/after", 0o644, "after"),
+	)
+
+	root := applyLayers(t, base, top)
+	checkTree(t, root, false, map[string]string{
+		"etc":        "dir 0755",
+		"etc/kept":   `file 0644 "kept"`,
+		"opt":        "dir 0755",
+		"opt/before": `file 0644 "before"`,
+		"opt/after":  `file 0644 "after"`,
+	})
+}
+
+func TestApplyLayerOpaqueKeepsLayerSubdirectories(t *testing.T) {
+	base := buildLayer(t,
+		dir("data", 0o755),
+		dir("data/sub", 0o755),
+		file("data/sub/lower", 0o644, "lower"),
+	)
+	top := buildLayer(t,
+		dir("data", 0o755),
+		dir("data/sub", 0o755),
+		file("data/sub/upper", 0o644, "upper"),
+		file("data/.wh..wh..opq", 0o644, ""),
+	)
+
+	root := applyLayers(t, base, top)
+	checkTree(t, root, false, map[string]string{
+		"data":           "dir 0755",
+		"data/sub":       "dir 0755",
+		"data/sub/upper": `file 0644 "upper"`,
+	})
+}
+
+func TestApplyLayerHardlinks(t *testing.T) {
+	base := buildLayer(t,
+		dir("bin", 0o755),
+		file("bin/busybox", 0o755, "busybox"),
+		hardlink("bin/sh", "bin/busybox"),
+		hardlink("bin/ls", "/bin/busybox"),
+		file("shared", 0o644, "v1"),
+		hardlink("shared-link", "shared"),
+	)
+	// Replacing one name of a lower hard link leaves the other with the old content.
+	top := buildLayer(t,
+		file("shared", 0o600, "v2"),
+		dir("bin", 0o755),
+		hardlink("bin/cat", "bin/busybox"),
+	)
+
+	root := applyLayers(t, base, top)
+	checkTree(t, root, false, map[string]string{
+		"bin":         "dir 0755",
+		"bin/busybox": `file 0755 "busybox"`,
+		"bin/cat":     "link to bin/busybox",
+		"bin/ls":      "link to bin/busybox",
+		"bin/sh":      "link to bin/busybox",
+		"shared":      `file 0600 "v2"`,
+		"shared-link": `file 0644 "v1"`,
+	})
+}
+
+func TestApplyLayerTypeChanges(t *testing.T) {
+	// The lower directory has content, which the entry replacing it hides along with the directory.
+	lowerDir := buildLayer(t,
+		dir("d", 0o755),
+		dir("d/sub", 0o755),
+		file("d/sub/file", 0o644, "lower"),
+		file("other", 0o644, "other"),
+	)
+	lowerFile := buildLayer(t, file("d", 0o644, "lower"))
+	lowerSymlink := buildLayer(t, dir("target", 0o755), symlink("d", "target"))
+
+	tests := []struct {
+		name  string
+		lower []byte
+		top   []testEntry
+		want  map[string]string
+	}{
+		{
+			name:  "directory replaced by a file",
+			lower: lowerDir,
+			top:   []testEntry{file("d", 0o600, "upper")},
+			want:  map[string]string{"d": `file 0600 "upper"`, "other": `file 0644 "other"`},
+		},
+		{
+			name:  "directory replaced by a symlink",
+			lower: lowerDir,
+			top:   []testEntry{symlink("d", "other")},
+			want:  map[string]string{"d": "symlink other", "other": `file 0644 "other"`},
+		},
+		{
+			name:  "directory replaced by a hard link",
+			lower: lowerDir,
+			top:   []testEntry{hardlink("d", "other")},
+			want:  map[string]string{"d": `file 0644 "other"`, "other": "link to d"},
+		},
+		{
+			name:  "file replaced by a directory",
+			lower: lowerFile,
+			top:   []testEntry{dir("d", 0o750), file("d/file", 0o644, "upper")},
+			want:  map[string]string{"d": "dir 0750", "d/file": `file 0644 "upper"`},
+		},
+		{
+			name:  "symlink replaced by a directory",
+			lower: lowerSymlink,
+			top:   []testEntry{dir("d", 0o750), file("d/file", 0o644, "upper")},
+			want:  map[string]string{"target": "dir 0755", "d": "dir 0750", "d/file": `file 0644 "upper"`},
+		},
+		{
+			name:  "symlink replaced by a file",
+			lower: lowerSymlink,
+			top:   []testEntry{file("d", 0o644, "upper")},
+			want:  map[string]string{"target": "dir 0755", "d": `file 0644 "upper"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := applyLayers(t, tt.lower, buildLayer(t, tt.top...))
+			if tt.want != nil {
+				checkTree(t, root, false, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveKeepsDirectories(t *testing.T) {
+	root := applyLayers(t, buildLayer(t, dir("d", 0o755), file("d/file", 0o644, "kept")))
+
+	err := ExtractArchive(bytes.NewReader(buildLayer(t, file("d", 0o644, "replaced"))), root, "/")
+	if err == nil {
+		t.Error("archive replaced a directory, want an error")
+	}
+	checkTree(t, root, false, map[string]string{"d": "dir 0755", "d/file": `file 0644 "kept"`})
+}
+
+func TestApplyLayerModesAndOwners(t *testing.T) {
+	owners := os.Geteuid() == 0
+	layer := buildLayer(t,
+		// The read-only directory only gets its mode once its content is written.
+		owned(dir("ro", 0o555), 10, 20),
+		owned(file("ro/file", 0o444, "read only"), 30, 40),
+		dir("tmp", 0o1777),
+		owned(file("suid", 0o4755, "suid"), 0, 0),
+		owned(file("sgid", 0o2711, "sgid"), 50, 60),
+		owned(symlink("link", "suid"), 70, 80),
+		dir("private", 0o700),
+		dir("private/nested", 0o750),
+	)
+
+	root := applyLayers(t, gzipLayer(t, layer))
+	want := map[string]string{
+		"ro":             "dir 0555",
+		"ro/file":        `file 0444 "read only"`,
+		"tmp":            "dir 1777",
+		"suid":           `file 4755 "suid"`,
+		"sgid":           `file 2711 "sgid"`,
+		"link":           "symlink suid",
+		"private":        "dir 0700",
+		"private/nested": "dir 0750",
+	}
+	if owners {
+		for name, owner := range map[string]string{
+			"ro": "10:20", "ro/file": "30:40", "tmp": "0:0", "suid": "0:0", "sgid": "50:60",
+			"link": "70:80", "private": "0:0", "private/nested": "0:0",
+		} {
+			want[name] += " " + owner
+		}
+	}
+	checkTree(t, root, owners, want)
+}
+
+// gzipLayer compresses a layer; applyLayers detects the compression from the content.
+func gzipLayer(t *testing.T, layer []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(layer)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDeferredDirectoryModeDoesNotFollowSymlinks(t *testing.T) {
+	// The directory is replaced with a symlink to a host directory after its entry, so the deferred pass
+	// that gives directories their mode would chmod the host directory if it followed the symlink.
+	outside := t.TempDir()
+	err := os.Chmod(outside, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := buildLayer(t,
+		dir("data", 0o777),
+		symlink("data", outside),
+	)
+
+	// gocker cp refuses to replace the directory at all, and stops before the deferred pass.
+	extractors := map[string]struct {
+		extract func(root string) error
+		want    map[string]string
+	}{
+		"layer": {
+			extract: func(root string) error {
+				return ApplyLayer(bytes.NewReader(layer), tarMediaType, root)
+			},
+			want: map[string]string{"data": "symlink " + outside},
+		},
+		"gocker cp": {
+			extract: func(root string) error {
+				err := ExtractArchive(bytes.NewReader(layer), root, "/")
+				if err == nil {
+					return errors.New("archive replaced a directory")
+				}
+				return nil
+			},
+		},
+	}
+	for name, tt := range extractors {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			err := tt.extract(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0o755 {
+				t.Errorf("mode of the symlink target changed to %v", info.Mode().Perm())
+			}
+			if tt.want != nil {
+				checkTree(t, root, false, tt.want)
+			}
+		})
+	}
+}
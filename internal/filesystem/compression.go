@@ -0,0 +1,51 @@
+package filesystem
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/marcospedro/gocker/internal/image"
+)
+
+// decompressors open a decompressing reader for each layer compression.
+var decompressors = map[image.Compression]func(io.Reader) (io.ReadCloser, error){
+	image.Uncompressed: func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(r), nil
+	},
+	image.Gzip: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	image.Zstd: func(r io.Reader) (io.ReadCloser, error) {
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	},
+}
+
+// decompress returns the tar stream of a layer. The compression is sniffed from the magic bytes of the blob,
+// which registries and archives get right more often than media types; a media type declaring a compression
+// the content does not have is an error, and an unknown one is ignored.
+func decompress(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read layer: %w", err)
+	}
+
+	compression := image.DetectCompression(header)
+	declared, known := image.MediaTypeCompression(mediaType)
+	if known && declared != image.Uncompressed && declared != compression {
+		return nil, fmt.Errorf("layer of media type %s is not %s compressed", mediaType, declared)
+	}
+
+	reader, err := decompressors[compression](buffered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s reader: %w", compression, err)
+	}
+	return reader, nil
+}
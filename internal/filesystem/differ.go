@@ -0,0 +1,490 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/marcospedro/gocker/internal/image"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// layerMediaType is the media type of the layers written by CreateLayer.
+	layerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	// overlayOpaqueXattr marks a directory of an overlayfs upper directory that hides its lower content.
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// ChangeKind is the kind of a change of a root filesystem compared with its parent.
+type ChangeKind int
+
+const (
+	ChangeAdd ChangeKind = iota
+	ChangeModify
+	ChangeDelete
+)
+
+// String returns the letter docker diff shows for the kind: A, C or D.
+func (k ChangeKind) String() string {
+	return map[ChangeKind]string{ChangeAdd: "A", ChangeModify: "C", ChangeDelete: "D"}[k]
+}
+
+// Change is a path of a root filesystem, such as /etc/passwd, added, modified or deleted compared with its parent.
+// Opaque marks a directory whose content in the parent is hidden, as when a directory replaces another one.
+type Change struct {
+	Path   string
+	Kind   ChangeKind
+	Opaque bool
+}
+
+// DiffTrees compares the root filesystem at current with its parent and returns the changes, sorted by path.
+// Files are compared on their type, mode, ownership, device numbers, size, modification time and link target,
+// like docker diff; directories are not reported as modified only because their content changed.
+// A deleted directory is a single change, its content being deleted with it.
+func DiffTrees(parent, current string) ([]Change, error) {
+	var changes []Change
+	err := filepath.WalkDir(current, func(hostPath string, entry fs.DirEntry, err error) error {
+		if err != nil || hostPath == current {
+			return err
+		}
+		name := "/" + filepath.ToSlash(mustRel(current, hostPath))
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		parentInfo, err := lstatMissing(filepath.Join(parent, name))
+		if os.IsNotExist(err) {
+			changes = append(changes, Change{Path: name, Kind: ChangeAdd})
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		modified, err := fileChanged(parentInfo, info, filepath.Join(parent, name), hostPath)
+		if err != nil {
+			return err
+		}
+		// A directory replacing a file, or the reverse, deletes the old path before the new one is added.
+		if parentInfo.IsDir() != info.IsDir() {
+			changes = append(changes, Change{Path: name, Kind: ChangeDelete}, Change{Path: name, Kind: ChangeAdd})
+			if info.IsDir() {
+				return nil
+			}
+		} else if modified {
+			changes = append(changes, Change{Path: name, Kind: ChangeModify})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.WalkDir(parent, func(hostPath string, entry fs.DirEntry, err error) error {
+		if err != nil || hostPath == parent {
+			return err
+		}
+		name := "/" + filepath.ToSlash(mustRel(parent, hostPath))
+
+		info, err := lstatMissing(filepath.Join(current, name))
+		if os.IsNotExist(err) {
+			changes = append(changes, Change{Path: name, Kind: ChangeDelete})
+		} else if err != nil {
+			return err
+		}
+		// The content of a deleted or replaced directory goes with it.
+		if entry.IsDir() && (info == nil || !info.IsDir()) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortChanges(changes)
+	return changes, nil
+}
+
+// DiffUpperDir returns the changes recorded in the upper directory of an overlayfs mount whose lower
+// directory is lower, sorted by path. Overlayfs records deletions as 0/0 character devices and directories
+// hiding their lower content with the trusted.overlay.opaque attribute; the rest of upper is what was added
+// or modified, told apart by whether lower has the path.
+func DiffUpperDir(upper, lower string) ([]Change, error) {
+	var changes []Change
+	err := filepath.WalkDir(upper, func(hostPath string, entry fs.DirEntry, err error) error {
+		if err != nil || hostPath == upper {
+			return err
+		}
+		name := "/" + filepath.ToSlash(mustRel(upper, hostPath))
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if isOverlayWhiteout(info) {
+			changes = append(changes, Change{Path: name, Kind: ChangeDelete})
+			return nil
+		}
+
+		change := Change{Path: name, Kind: ChangeModify}
+		lowerInfo, err := lstatMissing(filepath.Join(lower, name))
+		if os.IsNotExist(err) {
+			change.Kind = ChangeAdd
+		} else if err != nil {
+			return err
+		}
+		// A directory replacing a file, or the reverse, deletes the old path before the new one is added,
+		// as in DiffTrees, so the lower directory goes with its content.
+		if lowerInfo != nil && lowerInfo.IsDir() != info.IsDir() {
+			changes = append(changes, Change{Path: name, Kind: ChangeDelete}, Change{Path: name, Kind: ChangeAdd})
+			return nil
+		}
+		if info.IsDir() {
+			opaque, err := isOverlayOpaque(hostPath)
+			if err != nil {
+				return err
+			}
+			change.Opaque = opaque && change.Kind == ChangeModify
+			// Directories are copied up whenever something below them changes; only report real changes.
+			if change.Kind == ChangeModify && !change.Opaque {
+				modified, err := fileChanged(lowerInfo, info, filepath.Join(lower, name), hostPath)
+				if err != nil || !modified {
+					return err
+				}
+			}
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortChanges(changes)
+	return changes, nil
+}
+
+// CreateLayer writes the changes of the root filesystem at root as a gzip compressed OCI layer into dir,
+// named as image.LayerPath names it. It returns the descriptor of the layer, whose digest is the one of the
+// compressed blob, and the DiffID, the digest of the uncompressed tar listed in the image config.
+func CreateLayer(dir, root string, changes []Change) (image.Layer, string, error) {
+	tmp, err := os.CreateTemp(dir, ".layer-*")
+	if err != nil {
+		return image.Layer{}, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	blobHash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, blobHash)}
+	gz := gzip.NewWriter(counter)
+	diffHash := sha256.New()
+
+	err = WriteLayer(io.MultiWriter(gz, diffHash), root, changes)
+	if err != nil {
+		return image.Layer{}, "", err
+	}
+	err = gz.Close()
+	if err != nil {
+		return image.Layer{}, "", err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return image.Layer{}, "", err
+	}
+
+	layer := image.Layer{
+		MediaType: layerMediaType,
+		Digest:    "sha256:" + hex.EncodeToString(blobHash.Sum(nil)),
+		Size:      counter.n,
+	}
+	err = os.Rename(tmp.Name(), image.LayerPath(dir, layer))
+	if err != nil {
+		return image.Layer{}, "", err
+	}
+	return layer, "sha256:" + hex.EncodeToString(diffHash.Sum(nil)), nil
+}
+
+// WriteLayer writes the changes of the root filesystem at root as an uncompressed layer tar to w.
+// Deletions become .wh.<name> whiteouts and opaque directories get a .wh..wh..opq marker; a deletion of a path
+// that is added again is written first, so the whiteout only applies to the parent layers.
+// The parent directories of every change are written too, so they keep their ownership and mode,
+// and files sharing an inode are written once and then as hard links.
+func WriteLayer(w io.Writer, root string, changes []Change) error {
+	lw := &layerWriter{tw: tar.NewWriter(w), root: root, written: map[string]bool{}, inodes: map[fileID]string{}}
+	for _, change := range changes {
+		name := strings.TrimPrefix(path.Clean("/"+change.Path), "/")
+		if name == "" {
+			continue
+		}
+
+		err := lw.writeParents(name)
+		if err != nil {
+			return err
+		}
+
+		if change.Kind == ChangeDelete {
+			dir, base := path.Split(name)
+			err = lw.writeMarker(path.Join(dir, whiteoutPrefix+base))
+		} else {
+			err = lw.writeEntry(name)
+			if err == nil && change.Opaque {
+				err = lw.writeMarker(path.Join(name, opaqueWhiteout))
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s to layer: %w", change.Path, err)
+		}
+	}
+	return lw.tw.Close()
+}
+
+// layerWriter writes the entries of a layer tar from a root filesystem.
+type layerWriter struct {
+	tw      *tar.Writer
+	root    string
+	written map[string]bool
+	inodes  map[fileID]string
+}
+
+// fileID identifies a file by its device and inode number, as inode numbers are only unique on their device
+// and the trees written may span several, such as the volumes of a container.
+type fileID struct {
+	dev, ino uint64
+}
+
+// writeParents writes the parent directories of name not written yet, from the top.
+func (lw *layerWriter) writeParents(name string) error {
+	var parents []string
+	for dir := path.Dir(name); dir != "." && !lw.written[dir]; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	slices.Reverse(parents)
+
+	for _, dir := range parents {
+		err := lw.writeEntry(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEntry writes the file at name of the root filesystem.
+func (lw *layerWriter) writeEntry(name string) error {
+	return lw.writeFile(name, filepath.Join(lw.root, name))
+}
+
+// writeFile writes the file at hostPath as the entry name, with its ownership, times and extended attributes.
+func (lw *layerWriter) writeFile(name, hostPath string) error {
+	if lw.written[name] {
+		return nil
+	}
+	lw.written[name] = true
+
+	info, err := os.Lstat(hostPath)
+	if err != nil {
+		return err
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(hostPath)
+		if err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.Format = tar.FormatPAX
+
+	hdr.PAXRecords, err = xattrRecords(hostPath)
+	if err != nil {
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+		id := fileID{dev: uint64(stat.Dev), ino: stat.Ino}
+		if first, seen := lw.inodes[id]; seen {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			lw.inodes[id] = name
+		}
+	}
+
+	err = lw.tw.WriteHeader(hdr)
+	if err != nil || hdr.Typeflag != tar.TypeReg {
+		return err
+	}
+
+	file, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(lw.tw, file)
+	return err
+}
+
+// writeMarker writes an empty whiteout or opaque marker file.
+func (lw *layerWriter) writeMarker(name string) error {
+	return lw.tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Format: tar.FormatPAX})
+}
+
+// xattrRecords returns the extended attributes of a file as PAX records, leaving out the overlayfs ones.
+func xattrRecords(hostPath string) (map[string]string, error) {
+	size, err := unix.Llistxattr(hostPath, nil)
+	if errors.Is(err, unix.ENOTSUP) || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(hostPath, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" || strings.HasPrefix(name, "trusted.overlay.") {
+			continue
+		}
+		value, err := getxattr(hostPath, name)
+		if err != nil {
+			return nil, err
+		}
+		records[paxXattrPrefix+name] = string(value)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return records, nil
+}
+
+func getxattr(hostPath, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(hostPath, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(hostPath, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// fileChanged reports whether a file differs from its version in the parent. Directory times are ignored,
+// as they change with the content of the directory, which is compared entry by entry.
+func fileChanged(old, new os.FileInfo, oldPath, newPath string) (bool, error) {
+	if old.Mode() != new.Mode() {
+		return true, nil
+	}
+	oldStat, ok1 := old.Sys().(*syscall.Stat_t)
+	newStat, ok2 := new.Sys().(*syscall.Stat_t)
+	if ok1 && ok2 && (oldStat.Uid != newStat.Uid || oldStat.Gid != newStat.Gid || oldStat.Rdev != newStat.Rdev) {
+		return true, nil
+	}
+	if new.IsDir() {
+		return false, nil
+	}
+	if old.Size() != new.Size() || !old.ModTime().Equal(new.ModTime()) {
+		return true, nil
+	}
+
+	if new.Mode()&os.ModeSymlink != 0 {
+		oldLink, err := os.Readlink(oldPath)
+		if err != nil {
+			return false, err
+		}
+		newLink, err := os.Readlink(newPath)
+		if err != nil {
+			return false, err
+		}
+		return oldLink != newLink, nil
+	}
+	return false, nil
+}
+
+// isOverlayWhiteout reports whether a file of an overlayfs upper directory records a deletion.
+func isOverlayWhiteout(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0
+}
+
+// isOverlayOpaque reports whether a directory of an overlayfs upper directory hides its lower content.
+func isOverlayOpaque(hostPath string) (bool, error) {
+	value, err := getxattr(hostPath, overlayOpaqueXattr)
+	if errors.Is(err, unix.ENODATA) || errors.Is(err, unix.ENOTSUP) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(value) == "y", nil
+}
+
+// sortChanges sorts changes by path, a deletion coming before an addition of the same path.
+func sortChanges(changes []Change) {
+	slices.SortStableFunc(changes, func(a, b Change) int {
+		if c := strings.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return int(b.Kind) - int(a.Kind)
+	})
+}
+
+// lstatMissing is os.Lstat, also reporting a path below a file, which cannot exist, as not existing.
+func lstatMissing(hostPath string) (os.FileInfo, error) {
+	info, err := os.Lstat(hostPath)
+	if errors.Is(err, unix.ENOTDIR) {
+		return nil, fs.ErrNotExist
+	}
+	return info, err
+}
+
+func mustRel(base, target string) string {
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		panic(err)
+	}
+	return rel
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	n, err := c.w.Write(data)
+	c.n += int64(n)
+	return n, err
+}
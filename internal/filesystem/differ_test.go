@@ -0,0 +1,194 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// parentLayer is the root filesystem the differ tests compare against.
+func parentLayer(t *testing.T) []byte {
+	return buildLayer(t,
+		dir("etc", 0o755),
+		file("etc/kept", 0o644, "kept"),
+		file("etc/modified", 0o644, "old"),
+		file("etc/deleted", 0o644, "deleted"),
+		dir("removed", 0o755),
+		file("removed/file", 0o644, "gone"),
+		dir("d", 0o755),
+		dir("d/sub", 0o755),
+		file("d/sub/file", 0o644, "lower"),
+		file("f", 0o644, "lower"),
+	)
+}
+
+func checkChanges(t *testing.T, got, want []Change) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes mismatch\ngot:  %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	parent := applyLayers(t, parentLayer(t))
+	current := applyLayers(t, parentLayer(t), buildLayer(t,
+		dir("etc", 0o755),
+		file("etc/modified", 0o644, "new content"),
+		file("etc/.wh.deleted", 0o644, ""),
+		file("etc/added", 0o644, "added"),
+		file(".wh.removed", 0o644, ""),
+		// The directory and the file swap types.
+		file("d", 0o644, "upper"),
+		dir("f", 0o755),
+		file("f/file", 0o644, "upper"),
+	))
+
+	changes, err := DiffTrees(parent, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(t, changes, []Change{
+		{Path: "/d", Kind: ChangeDelete},
+		{Path: "/d", Kind: ChangeAdd},
+		{Path: "/etc/added", Kind: ChangeAdd},
+		{Path: "/etc/deleted", Kind: ChangeDelete},
+		{Path: "/etc/modified", Kind: ChangeModify},
+		{Path: "/f", Kind: ChangeDelete},
+		{Path: "/f", Kind: ChangeAdd},
+		{Path: "/f/file", Kind: ChangeAdd},
+		{Path: "/removed", Kind: ChangeDelete},
+	})
+}
+
+// overlayUpper builds an overlayfs upper directory by hand, as mounting one needs a kernel allowing it:
+// whiteouts are 0/0 character devices and opaque directories carry trusted.overlay.opaque, which both need root.
+func overlayUpper(t *testing.T) string {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("overlayfs whiteouts need root")
+	}
+	upper := applyLayers(t, buildLayer(t,
+		dir("etc", 0o755),
+		file("etc/modified", 0o644, "new content"),
+		file("etc/added", 0o644, "added"),
+		// rm -rf /d && touch /d
+		file("d", 0o644, "upper"),
+		// rm /f && mkdir /f && touch /f/file
+		dir("f", 0o755),
+		file("f/file", 0o644, "upper"),
+		// rm -rf /removed && mkdir /removed
+		dir("removed", 0o755),
+	))
+	err := unix.Mknod(filepath.Join(upper, "etc/deleted"), unix.S_IFCHR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"f", "removed"} {
+		err := unix.Setxattr(filepath.Join(upper, name), overlayOpaqueXattr, []byte("y"), 0)
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skip("the file system of the test directory has no trusted extended attributes")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Restore the time of the directory, which the whiteout changed, as overlayfs copies it up unchanged.
+	err = os.Chtimes(filepath.Join(upper, "etc"), modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upper
+}
+
+func TestDiffUpperDir(t *testing.T) {
+	lower := applyLayers(t, parentLayer(t))
+	upper := overlayUpper(t)
+
+	changes, err := DiffUpperDir(upper, lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(t, changes, []Change{
+		{Path: "/d", Kind: ChangeDelete},
+		{Path: "/d", Kind: ChangeAdd},
+		{Path: "/etc/added", Kind: ChangeAdd},
+		{Path: "/etc/deleted", Kind: ChangeDelete},
+		{Path: "/etc/modified", Kind: ChangeModify},
+		{Path: "/f", Kind: ChangeDelete},
+		{Path: "/f", Kind: ChangeAdd},
+		{Path: "/f/file", Kind: ChangeAdd},
+		{Path: "/removed", Kind: ChangeModify, Opaque: true},
+	})
+}
+
+func TestUpperDirLayerApplies(t *testing.T) {
+	lower := applyLayers(t, parentLayer(t))
+	upper := overlayUpper(t)
+	changes, err := DiffUpperDir(upper, lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layer bytes.Buffer
+	err = WriteLayer(&layer, upper, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := applyLayers(t, parentLayer(t), layer.Bytes())
+	checkTree(t, root, false, map[string]string{
+		"etc":          "dir 0755",
+		"etc/kept":     `file 0644 "kept"`,
+		"etc/modified": `file 0644 "new content"`,
+		"etc/added":    `file 0644 "added"`,
+		"d":            `file 0644 "upper"`,
+		"f":            "dir 0755",
+		"f/file":       `file 0644 "upper"`,
+		"removed":      "dir 0755",
+	})
+}
+
+func TestWriteArchiveHardLinksStayOnTheirDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting file systems needs root")
+	}
+	// Two fresh tmpfs mounts number their inodes alike, so their files share inode numbers.
+	root := t.TempDir()
+	for _, dir := range []string{"a", "b"} {
+		target := filepath.Join(root, dir)
+		err := os.Mkdir(target, 0o755)
+		if err == nil {
+			err = unix.Mount("tmpfs", target, "tmpfs", 0, "")
+		}
+		if err != nil {
+			t.Skipf("cannot mount tmpfs: %v", err)
+		}
+		t.Cleanup(func() { unix.Unmount(target, unix.MNT_DETACH) })
+
+		err = os.WriteFile(filepath.Join(target, "file"), []byte(dir), 0o644)
+		if err == nil {
+			err = os.Chtimes(filepath.Join(target, "file"), modTime, modTime)
+		}
+		if err == nil {
+			err = os.Link(filepath.Join(target, "file"), filepath.Join(target, "link"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	err := WriteArchive(&archive, root, "/", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted := applyLayers(t, archive.Bytes())
+	tree := describeTree(t, extracted, false)
+	if tree["b/file"] != `file 0644 "b"` || tree["b/link"] != "link to b/file" {
+		t.Errorf("files of the second device are %q and %q", tree["b/file"], tree["b/link"])
+	}
+}
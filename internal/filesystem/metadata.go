@@ -0,0 +1,115 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// paxXattrPrefix prefixes the PAX records holding extended attributes, e.g. SCHILY.xattr.security.capability.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// applyMetadata gives an extracted entry the ownership, permissions, extended attributes and times of its header.
+// Ownership is applied first, since chown clears the setuid and setgid bits and the security.capability attribute.
+//
+// Without root privileges, files cannot be given away: every owner is remapped to the extracting user,
+// who stands for root in a rootless container. Attributes the filesystem or the privileges do not allow
+// are skipped the same way. Symlinks get their ownership and times but no mode, which Linux does not have for them.
+func applyMetadata(hdr *tar.Header, target string) error {
+	rootless := os.Geteuid() != 0
+	if !rootless {
+		err := os.Lchown(target, hdr.Uid, hdr.Gid)
+		// EINVAL means the ids are not mapped in the user namespace gocker runs in.
+		if err != nil && !errors.Is(err, unix.EINVAL) {
+			return err
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		err := unix.Lsetxattr(target, name, []byte(value), 0)
+		if errors.Is(err, unix.ENOTSUP) || (rootless && errors.Is(err, unix.EPERM)) {
+			fmt.Printf("Skipping extended attribute %s of %s: %v\n", name, hdr.Name, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set extended attribute %s: %w", name, err)
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return applyModeAndTimes(hdr, target)
+}
+
+// applyModeAndTimes sets the permissions, including the setuid, setgid and sticky bits, and the access and
+// modification times of an entry, without following symlinks. Directories get theirs once the layer is extracted,
+// as writing their content updates their times and a read-only mode could prevent writing it.
+func applyModeAndTimes(hdr *tar.Header, target string) error {
+	if hdr.Typeflag != tar.TypeSymlink {
+		err := chmodNoFollow(target, uint32(hdr.Mode&0o7777))
+		if err != nil {
+			return fmt.Errorf("failed to set mode: %w", err)
+		}
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	times := []unix.Timespec{timespec(atime), timespec(hdr.ModTime)}
+
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fmt.Errorf("failed to set times: %w", err)
+	}
+	return nil
+}
+
+// chmodNoFollow changes the mode of target without following it if it is a symlink, which chmod would do:
+// by the time the deferred directory pass runs, or while gocker cp writes into a running container, the entry
+// may have been replaced with a symlink pointing anywhere on the host. The entry is opened with O_PATH and
+// O_NOFOLLOW and its mode changed through the descriptor with fchmodat2, or through /proc/self/fd on kernels
+// without it. gocker cp runs inside the root filesystem of the container, which may have no /proc.
+// Symlinks themselves have no mode and are left alone.
+func chmodNoFollow(target string, mode uint32) error {
+	fd, err := unix.Open(target, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: target, Err: err}
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	err = unix.Fstat(fd, &st)
+	if err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return nil
+	}
+	err = unix.Fchmodat(fd, "", mode, unix.AT_EMPTY_PATH)
+	if err == unix.EOPNOTSUPP {
+		err = unix.Chmod("/proc/self/fd/"+strconv.Itoa(fd), mode)
+	}
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: target, Err: err}
+	}
+	return nil
+}
+
+func timespec(t time.Time) unix.Timespec {
+	if t.IsZero() {
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	}
+	return unix.NsecToTimespec(t.UnixNano())
+}
@@ -0,0 +1,90 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks limits the symlinks followed while resolving one path, as the kernel's ELOOP limit does.
+const maxSymlinks = 255
+
+// securePath returns the host path of a tar entry of a layer extracted into root.
+// The name must stay inside the root filesystem lexically, "../../etc/passwd" is rejected; its parent
+// directories are then resolved by resolveInRoot, so a symlink planted by an earlier entry cannot redirect
+// the entry outside root. The last component is not followed, as entries replace what is there.
+func securePath(root, name string) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("path %q escapes the root filesystem", name)
+	}
+	if clean == "." {
+		return root, nil
+	}
+
+	dir, err := resolveInRoot(root, path.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(clean)), nil
+}
+
+// resolveInRoot resolves every symlink of a path inside root as if root were /, like openat2 RESOLVE_IN_ROOT:
+// absolute targets start again from root and ".." never climbs above it. Components that do not exist yet
+// are kept as they are, since nothing can redirect them.
+func resolveInRoot(root, unsafePath string) (string, error) {
+	resolved := ""
+	remaining := unsafePath
+	links := 0
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = parentInRoot(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %q", unsafePath)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = target + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// parentInRoot returns the parent of a resolved path relative to root, which is its own parent.
+func parentInRoot(resolved string) string {
+	parent := path.Dir(resolved)
+	if parent == "." || parent == "/" {
+		return ""
+	}
+	return parent
+}
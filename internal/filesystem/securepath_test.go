@@ -0,0 +1,207 @@
+package filesystem
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// hostileSandbox creates a directory holding an empty root filesystem and, next to it, a directory outside
+// with a victim file, which no layer extracted into the root may reach. It returns the root and a check
+// failing the test if anything outside the root changed.
+func hostileSandbox(t *testing.T) (string, string, func()) {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{root, outside} {
+		err := os.Mkdir(dir, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(outside, "victim"), []byte("victim"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := describeTree(t, outside, true)
+	check := func() {
+		t.Helper()
+		entries, err := os.ReadDir(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("layer created %d entries next to the root filesystem", len(entries)-2)
+		}
+		got := describeTree(t, outside, true)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("layer wrote outside the root filesystem\ngot:  %v\nwant: %v", got, want)
+		}
+	}
+	return root, outside, check
+}
+
+func TestApplyHostileLayer(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries func(outside string) []testEntry
+		wantErr bool
+		// want describes entries of the root filesystem when the layer applies, <outside> standing for the
+		// host path of the outside directory.
+		want map[string]string
+	}{
+		{
+			name:    "file climbing out with ..",
+			entries: func(string) []testEntry { return []testEntry{file("../outside/victim", 0o644, "pwned")} },
+			wantErr: true,
+		},
+		{
+			name: "file climbing out from a subdirectory",
+			entries: func(string) []testEntry {
+				return []testEntry{dir("a", 0o755), file("a/../../outside/new", 0o644, "pwned")}
+			},
+			wantErr: true,
+		},
+		{
+			name: "absolute symlink followed by a later entry",
+			entries: func(outside string) []testEntry {
+				return []testEntry{symlink("abs", outside), file("abs/victim", 0o644, "pwned")}
+			},
+			want: map[string]string{
+				"abs":              "symlink <outside>",
+				"<outside>/victim": `file 0644 "pwned"`,
+			},
+		},
+		{
+			name: "relative symlink climbing out",
+			entries: func(string) []testEntry {
+				return []testEntry{symlink("up", "../../../../.."), file("up/outside/victim", 0o644, "pwned")}
+			},
+			want: map[string]string{
+				"up":             "symlink ../../../../..",
+				"outside/victim": `file 0644 "pwned"`,
+			},
+		},
+		{
+			name: "file replacing a symlink",
+			entries: func(outside string) []testEntry {
+				return []testEntry{symlink("link", filepath.Join(outside, "victim")), file("link", 0o644, "pwned")}
+			},
+			want: map[string]string{
+				"link": `file 0644 "pwned"`,
+			},
+		},
+		{
+			name: "directory replaced by a symlink",
+			entries: func(outside string) []testEntry {
+				return []testEntry{dir("d", 0o777), symlink("d", outside), file("d/victim", 0o666, "pwned")}
+			},
+			want: map[string]string{
+				"d":                "symlink <outside>",
+				"<outside>/victim": `file 0666 "pwned"`,
+			},
+		},
+		{
+			name:    "hard link out of the root",
+			entries: func(string) []testEntry { return []testEntry{hardlink("h", "../outside/victim")} },
+			wantErr: true,
+		},
+		{
+			name: "hard link to an absolute symlink",
+			entries: func(outside string) []testEntry {
+				return []testEntry{symlink("s", filepath.Join(outside, "victim")), hardlink("h", "s")}
+			},
+			want: map[string]string{
+				"h": "symlink <outside>/victim",
+				"s": "link to h",
+			},
+		},
+		{
+			name:    "hard link to a missing absolute path",
+			entries: func(outside string) []testEntry { return []testEntry{hardlink("h", filepath.Join(outside, "victim"))} },
+			wantErr: true,
+		},
+		{
+			name:    "whiteout of ..",
+			entries: func(string) []testEntry { return []testEntry{dir("a", 0o755), file("a/.wh...", 0o644, "")} },
+			wantErr: true,
+		},
+		{
+			name:    "whiteout above the root",
+			entries: func(string) []testEntry { return []testEntry{file("../outside/.wh.victim", 0o644, "")} },
+			wantErr: true,
+		},
+		{
+			name: "whiteout through a symlink",
+			entries: func(outside string) []testEntry {
+				return []testEntry{symlink("l", outside), file("l/.wh.victim", 0o644, "")}
+			},
+			want: map[string]string{
+				"l": "symlink <outside>",
+			},
+		},
+		{
+			name: "opaque whiteout through a symlink",
+			entries: func(outside string) []testEntry {
+				return []testEntry{symlink("l", outside), file("l/.wh..wh..opq", 0o644, "")}
+			},
+			want: map[string]string{
+				"l": "symlink <outside>",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, outside, check := hostileSandbox(t)
+			layer := buildLayer(t, tt.entries(outside)...)
+
+			err := ApplyLayer(bytes.NewReader(layer), tarMediaType, root)
+			check()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("hostile layer applied, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree := describeTree(t, root, false)
+			for name, want := range tt.want {
+				name = strings.TrimPrefix(strings.ReplaceAll(name, "<outside>", outside), "/")
+				want = strings.ReplaceAll(want, "<outside>", outside)
+				if tree[name] != want {
+					t.Errorf("%s is %q, want %q", name, tree[name], want)
+				}
+			}
+		})
+	}
+}
+
+func FuzzApplyLayer(f *testing.F) {
+	// The sandbox is at another path in every run, so the seeds climb to it with ".." rather than absolute symlinks.
+	seeds := [][]testEntry{
+		{file("../outside/victim", 0o644, "pwned")},
+		{symlink("up", "../../../.."), file("up/outside/victim", 0o644, "pwned")},
+		{symlink("abs", "/outside"), file("abs/victim", 0o644, "pwned")},
+		{dir("d", 0o777), symlink("d", ".."), file("d/outside/victim", 0o666, "pwned")},
+		{hardlink("h", "../outside/victim")},
+		{symlink("l", ".."), file("l/outside/.wh.victim", 0o644, "")},
+		{symlink("l", "../outside"), file("l/.wh..wh..opq", 0o644, "")},
+		{dir("a", 0o755), file("a/.wh...", 0o644, "")},
+	}
+	for _, entries := range seeds {
+		f.Add(buildLayer(f, entries...))
+	}
+
+	f.Fuzz(func(t *testing.T, layer []byte) {
+		root, _, check := hostileSandbox(t)
+		_ = ApplyLayer(bytes.NewReader(layer), tarMediaType, root)
+		check()
+	})
+}
@@ -2,57 +2,226 @@ package filesystem
 
 import (
 	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+
+	"golang.org/x/sys/unix"
 )
 
+// sparseBlockSize is the size of the blocks handleSparse checks for holes.
+const sparseBlockSize = 64 * 1024
+
+// errSkipped is returned by handlers for entries deliberately left out of the root filesystem.
+var errSkipped = errors.New("entry skipped")
+
+// replaceEntry removes whatever exists at target before an entry of another kind is written there.
+// A directory of a lower layer is removed with its content, as the entry replacing it hides it entirely.
+func replaceEntry(target string) error {
+	info, err := os.Lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.RemoveAll(target)
+	}
+	return os.Remove(target)
+}
+
+// createFile creates a new file at target for the content of an entry. It fails rather than follow a symlink or
+// open a file that appeared at target since replaceEntry cleared it.
+func createFile(target string) (*os.File, error) {
+	return os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL|unix.O_NOFOLLOW, 0o666)
+}
+
 func handleSymlink(hdr *tar.Header, r io.Reader, root string) error {
-	target := filepath.Join(root, hdr.Name)
-	err := os.MkdirAll(filepath.Dir(target), dirPerm)
+	target, err := securePath(root, hdr.Name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), dirPerm)
+	if err != nil {
+		return err
+	}
+	err = replaceEntry(target)
 	if err != nil {
 		return err
 	}
-	_ = os.Remove(target)
 	return os.Symlink(hdr.Linkname, target)
 }
 
 func handleLink(hdr *tar.Header, r io.Reader, root string) error {
-	target := filepath.Join(root, hdr.Name)
-	err := os.MkdirAll(filepath.Dir(target), dirPerm)
+	target, err := securePath(root, hdr.Name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), dirPerm)
 	if err != nil {
 		return err
 	}
 
-	linkTarget := filepath.Join(root, hdr.Linkname)
-	_ = os.Remove(target)
+	linkTarget, err := securePath(root, hdr.Linkname)
+	if err != nil {
+		return err
+	}
+	err = replaceEntry(target)
+	if err != nil {
+		return err
+	}
 	return os.Link(linkTarget, target)
 }
 
 func handleReg(hdr *tar.Header, r io.Reader, root string) error {
-	target := filepath.Join(root, hdr.Name)
-	err := os.MkdirAll(filepath.Dir(target), dirPerm)
+	target, err := securePath(root, hdr.Name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), dirPerm)
 	if err != nil {
 		return err
 	}
 
-	outFile, err := os.Create(target)
+	// A file of a lower layer is replaced rather than overwritten, so its other hard links keep their content.
+	err = replaceEntry(target)
+	if err != nil {
+		return err
+	}
+	outFile, err := createFile(target)
 	if err != nil {
 		return err
 	}
 
 	defer outFile.Close()
 
-	err = os.Chmod(target, os.FileMode(hdr.Mode))
+	_, err = io.Copy(outFile, r)
+	return err
+}
+
+func handleDir(hdr *tar.Header, r io.Reader, root string) error {
+	target, err := securePath(root, hdr.Name)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(outFile, r)
+	// Anything but a directory is replaced, so a symlink of a lower layer cannot redirect the directory elsewhere.
+	info, err := os.Lstat(target)
+	if err == nil && info.IsDir() {
+		return nil
+	}
+	if err == nil {
+		err = os.Remove(target)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(target), dirPerm)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(target, dirPerm)
+}
+
+// handleSparse writes a GNU sparse file. The tar reader fills the holes with zeros; runs of zero blocks are
+// skipped with a seek instead of written, so the file keeps its holes.
+func handleSparse(hdr *tar.Header, r io.Reader, root string) error {
+	target, err := securePath(root, hdr.Name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), dirPerm)
+	if err != nil {
+		return err
+	}
+
+	err = replaceEntry(target)
+	if err != nil {
+		return err
+	}
+	outFile, err := createFile(target)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	block := make([]byte, sparseBlockSize)
+	zeros := make([]byte, sparseBlockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			if bytes.Equal(block[:n], zeros[:n]) {
+				_, err = outFile.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = outFile.Write(block[:n])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// A trailing hole is only recorded by the file size.
+	return outFile.Truncate(hdr.Size)
+}
+
+// handleDevice creates a character or block device node. Creating device nodes needs CAP_MKNOD,
+// so without root privileges, or when the kernel refuses it as in user namespaces, the node is skipped.
+func handleDevice(hdr *tar.Header, r io.Reader, root string) error {
+	target, err := securePath(root, hdr.Name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), dirPerm)
+	if err != nil {
+		return err
+	}
+
+	if os.Geteuid() != 0 {
+		fmt.Printf("Skipping device node %s: creating devices requires root\n", hdr.Name)
+		return errSkipped
+	}
+
+	mode := uint32(unix.S_IFCHR)
+	if hdr.Typeflag == tar.TypeBlock {
+		mode = unix.S_IFBLK
+	}
+	err = replaceEntry(target)
+	if err != nil {
+		return err
+	}
+	err = unix.Mknod(target, mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+	if errors.Is(err, unix.EPERM) {
+		fmt.Printf("Skipping device node %s: %v\n", hdr.Name, err)
+		return errSkipped
+	}
 	return err
 }
 
-func handleDir(hdr *tar.Header, r io.Reader, root string) error {
-	target := filepath.Join(root, hdr.Name)
-	return os.MkdirAll(target, dirPerm)
+// handleFifo creates a named pipe.
+func handleFifo(hdr *tar.Header, r io.Reader, root string) error {
+	target, err := securePath(root, hdr.Name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), dirPerm)
+	if err != nil {
+		return err
+	}
+
+	err = replaceEntry(target)
+	if err != nil {
+		return err
+	}
+	return unix.Mkfifo(target, 0o600)
 }
@@ -0,0 +1,91 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// whiteoutPrefix marks a file deleting the file of the same name, without the prefix, from the lower layers.
+	whiteoutPrefix = ".wh."
+	// whiteoutMetaPrefix marks AUFS metadata, such as .wh..wh.plnk, which is not part of the filesystem.
+	whiteoutMetaPrefix = whiteoutPrefix + whiteoutPrefix
+	// opaqueWhiteout marks a directory whose content in the lower layers is hidden.
+	opaqueWhiteout = whiteoutMetaPrefix + ".opq"
+)
+
+// isWhiteout reports whether a tar entry is a whiteout marker rather than a file of the layer.
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(path.Base(name), whiteoutPrefix)
+}
+
+// applyWhiteout applies a whiteout marker of the layer being extracted, following the OCI layer rules:
+// .wh.<name> deletes <name> from the lower layers, and .wh..wh..opq in a directory deletes everything
+// the lower layers put in it. Entries of the current layer, listed in extracted, survive an opaque marker
+// whatever their order in the archive. Markers themselves are never written to the root filesystem.
+func applyWhiteout(name, root string, extracted map[string]bool) error {
+	dir, base := path.Split(name)
+	dir = path.Clean(dir)
+
+	switch {
+	case base == opaqueWhiteout:
+		return clearOpaqueDir(dir, root, extracted)
+	case strings.HasPrefix(base, whiteoutMetaPrefix):
+		return nil
+	default:
+		hidden := strings.TrimPrefix(base, whiteoutPrefix)
+		if hidden == "" || hidden == "." || hidden == ".." {
+			return fmt.Errorf("invalid whiteout %q", name)
+		}
+		target, err := securePath(root, path.Join(dir, hidden))
+		if err != nil {
+			return err
+		}
+		return os.RemoveAll(target)
+	}
+}
+
+// clearOpaqueDir removes the content of dir that does not come from the current layer.
+// Directories of the current layer are kept but cleared recursively, as their lower content is hidden too.
+func clearOpaqueDir(dir, root string, extracted map[string]bool) error {
+	hostDir, err := resolveInRoot(root, dir)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(hostDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if !extracted[name] {
+			err := os.RemoveAll(filepath.Join(hostDir, entry.Name()))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.IsDir() {
+			err := clearOpaqueDir(name, root, extracted)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// markExtracted records an entry of the current layer and its parent directories, which an opaque marker keeps.
+func markExtracted(name string, extracted map[string]bool) {
+	for name != "." && name != "/" && !extracted[name] {
+		extracted[name] = true
+		name = path.Dir(name)
+	}
+}
@@ -0,0 +1,734 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DockerArchive, OCIArchive and OCIDir are the formats images are saved in:
+	// a docker save tarball, and an OCI image layout as a tarball or a directory.
+	DockerArchive = "docker-archive"
+	OCIArchive    = "oci-archive"
+	OCIDir        = "oci-dir"
+
+	archiveManifestFile = "manifest.json"
+	repositoriesFile    = "repositories"
+	ociLayoutFile       = "oci-layout"
+	ociIndexFile        = "index.json"
+	ociLayoutVersion    = `{"imageLayoutVersion":"1.0.0"}`
+
+	// Annotations naming the images of an OCI layout; containerd sets the first, other tools only the second.
+	imageNameAnnotation = "io.containerd.image.name"
+	refNameAnnotation   = "org.opencontainers.image.ref.name"
+	// referenceTypeAnnotation marks the manifests BuildKit attaches to an image, like attestations, which are no images.
+	referenceTypeAnnotation = "vnd.docker.reference.type"
+
+	dockerConfigMediaType = "application/vnd.docker.container.image.v1+json"
+	ociConfigMediaType    = "application/vnd.oci.image.config.v1+json"
+)
+
+// layerMediaTypes are the layer media types per compression, in the Docker (false) and OCI (true) flavours.
+var layerMediaTypes = map[bool]map[Compression]string{
+	false: {
+		Uncompressed: "application/vnd.docker.image.rootfs.diff.tar",
+		Gzip:         "application/vnd.docker.image.rootfs.diff.tar.gzip",
+		Zstd:         "application/vnd.docker.image.rootfs.diff.tar.zstd",
+	},
+	true: {
+		Uncompressed: "application/vnd.oci.image.layer.v1.tar",
+		Gzip:         "application/vnd.oci.image.layer.v1.tar+gzip",
+		Zstd:         "application/vnd.oci.image.layer.v1.tar+zstd",
+	},
+}
+
+// SavedImage is an image of the layer store to save: its reference and the directory DownloadImage stored it in.
+type SavedImage struct {
+	Reference Reference
+	Dir       string
+}
+
+// LoadedImage is an image imported by LoadImages.
+type LoadedImage struct {
+	Reference Reference
+	Platform  Platform
+}
+
+// archiveManifestEntry is an image in the manifest.json of a docker save tarball.
+type archiveManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// ociDescriptor is a descriptor of an OCI image layout index, naming the image through its annotations.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// archiveBlob is a file of an archive with the digest the archive lists for it, empty for the files of a
+// docker save tarball, whose manifest.json has no digests.
+type archiveBlob struct {
+	path   string
+	digest string
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// SaveImages writes images in one of the save formats. Tarballs go to output, or to w when output is empty;
+// an OCI directory is created at output. Blobs shared by several images are written once.
+//
+// The docker-archive format is the one of docker save: the blobs under blobs/sha256, manifest.json listing
+// the config, tags and layers of every image, and the legacy repositories file. The OCI formats hold an
+// image layout whose index.json names every image with the io.containerd.image.name and
+// org.opencontainers.image.ref.name annotations.
+func SaveImages(images []SavedImage, format, output string, w io.Writer) error {
+	if format == OCIDir {
+		if output == "" {
+			return fmt.Errorf("the %s format needs an output directory", OCIDir)
+		}
+		err := os.MkdirAll(output, 0o755)
+		if err != nil {
+			return err
+		}
+		return saveOCILayout(images, &dirArchiveWriter{root: output, written: map[string]bool{}})
+	}
+
+	save, ok := map[string]func([]SavedImage, archiveWriter) error{
+		DockerArchive: saveDockerArchive,
+		OCIArchive:    saveOCILayout,
+	}[format]
+	if !ok {
+		return fmt.Errorf("unknown format %q: use %s, %s or %s", format, DockerArchive, OCIArchive, OCIDir)
+	}
+
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	tw := &tarArchiveWriter{tw: tar.NewWriter(w), written: map[string]bool{}}
+	err := save(images, tw)
+	if err != nil {
+		return err
+	}
+	return tw.tw.Close()
+}
+
+// saveDockerArchive writes images in the docker save format.
+func saveDockerArchive(images []SavedImage, aw archiveWriter) error {
+	var entries []archiveManifestEntry
+	repositories := map[string]map[string]string{}
+	for _, img := range images {
+		manifest, _, err := readStoredManifest(img.Dir)
+		if err != nil {
+			return err
+		}
+
+		entry := archiveManifestEntry{Config: blobPath(manifest.Config.Digest), RepoTags: []string{}}
+		err = aw.writeFile(entry.Config, filepath.Join(img.Dir, ConfigFileName))
+		if err != nil {
+			return err
+		}
+		for _, layer := range manifest.Layers {
+			entry.Layers = append(entry.Layers, blobPath(layer.Digest))
+			err := aw.writeFile(blobPath(layer.Digest), LayerPath(img.Dir, layer))
+			if err != nil {
+				return err
+			}
+		}
+
+		if img.Reference.Tag != "" && len(manifest.Layers) > 0 {
+			name := img.Reference.familiarName()
+			entry.RepoTags = append(entry.RepoTags, name+":"+img.Reference.Tag)
+			if repositories[name] == nil {
+				repositories[name] = map[string]string{}
+			}
+			_, top, _ := strings.Cut(manifest.Layers[len(manifest.Layers)-1].Digest, ":")
+			repositories[name][img.Reference.Tag] = top
+		}
+		entries = append(entries, entry)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	err = aw.writeBytes(archiveManifestFile, data)
+	if err != nil {
+		return err
+	}
+
+	data, err = json.Marshal(repositories)
+	if err != nil {
+		return err
+	}
+	return aw.writeBytes(repositoriesFile, data)
+}
+
+// saveOCILayout writes images as an OCI image layout, with the manifests stored as blobs as they were pulled.
+func saveOCILayout(images []SavedImage, aw archiveWriter) error {
+	index := ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []ociDescriptor{}}
+	for _, img := range images {
+		manifest, raw, err := readStoredManifest(img.Dir)
+		if err != nil {
+			return err
+		}
+		config, err := LoadConfig(img.Dir)
+		if err != nil {
+			return err
+		}
+
+		err = aw.writeFile(blobPath(manifest.Config.Digest), filepath.Join(img.Dir, ConfigFileName))
+		if err != nil {
+			return err
+		}
+		for _, layer := range manifest.Layers {
+			err := aw.writeFile(blobPath(layer.Digest), LayerPath(img.Dir, layer))
+			if err != nil {
+				return err
+			}
+		}
+
+		digest := sha256Digest(raw)
+		err = aw.writeBytes(blobPath(digest), raw)
+		if err != nil {
+			return err
+		}
+
+		descriptor := ociDescriptor{
+			MediaType:   manifest.MediaType,
+			Digest:      digest,
+			Size:        int64(len(raw)),
+			Platform:    &Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant},
+			Annotations: map[string]string{imageNameAnnotation: img.Reference.String()},
+		}
+		if img.Reference.Tag != "" {
+			descriptor.Annotations[refNameAnnotation] = img.Reference.Tag
+		}
+		index.Manifests = append(index.Manifests, descriptor)
+	}
+
+	err := aw.writeBytes(ociLayoutFile, []byte(ociLayoutVersion))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return aw.writeBytes(ociIndexFile, data)
+}
+
+// archiveWriter receives the files of a saved archive, skipping names already written.
+type archiveWriter interface {
+	writeBytes(name string, data []byte) error
+	writeFile(name, src string) error
+}
+
+type tarArchiveWriter struct {
+	tw      *tar.Writer
+	written map[string]bool
+}
+
+func (a *tarArchiveWriter) writeBytes(name string, data []byte) error {
+	if a.written[name] {
+		return nil
+	}
+	a.written[name] = true
+
+	err := a.tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = a.tw.Write(data)
+	return err
+}
+
+func (a *tarArchiveWriter) writeFile(name, src string) error {
+	if a.written[name] {
+		return nil
+	}
+	a.written[name] = true
+
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = a.tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: info.Size(), Typeflag: tar.TypeReg, ModTime: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, file)
+	return err
+}
+
+type dirArchiveWriter struct {
+	root    string
+	written map[string]bool
+}
+
+func (a *dirArchiveWriter) writeBytes(name string, data []byte) error {
+	if a.written[name] {
+		return nil
+	}
+	a.written[name] = true
+
+	target := filepath.Join(a.root, name)
+	err := os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(target, data)
+}
+
+func (a *dirArchiveWriter) writeFile(name, src string) error {
+	if a.written[name] {
+		return nil
+	}
+	a.written[name] = true
+
+	target := filepath.Join(a.root, name)
+	err := os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return err
+	}
+	return copyFile(src, target)
+}
+
+// LoadImages imports the images of a docker-archive or OCI layout into the layer store, from a tarball at input,
+// from r when input is empty, or from an OCI layout directory. store is called once per image with a function writing
+// the image into an empty directory, and moves that directory into the store once it succeeded. Each image is stored
+// as DownloadImage would: config.json, the layers as they are, compressed or not, and manifest.json, written last.
+// Blobs are verified against the digests the archive lists for them.
+func LoadImages(input string, r io.Reader, store func(Reference, Platform, func(dir string) error) error) ([]LoadedImage, error) {
+	dir := input
+	info, err := os.Stat(input)
+	if input == "" || (err == nil && !info.IsDir()) {
+		if input != "" {
+			file, err := os.Open(input)
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			r = file
+		}
+
+		dir, err = os.MkdirTemp("", "gocker-load-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		err = extractArchive(r, dir)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(filepath.Join(dir, archiveManifestFile))
+	if err == nil {
+		return loadDockerArchive(dir, store)
+	}
+	_, err = os.Stat(filepath.Join(dir, ociIndexFile))
+	if err == nil {
+		return loadOCILayout(dir, store)
+	}
+	return nil, fmt.Errorf("neither a docker-archive nor an OCI image layout: no %s or %s found", archiveManifestFile, ociIndexFile)
+}
+
+// extractArchive unpacks the regular files of an image tarball into dir, refusing names that leave it.
+func extractArchive(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid file name in archive: %s", header.Name)
+		}
+		target := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(target), 0o755)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+	}
+}
+
+// loadDockerArchive imports the images of a docker save tarball, once per tag. Untagged images are skipped.
+func loadDockerArchive(dir string, store func(Reference, Platform, func(dir string) error) error) ([]LoadedImage, error) {
+	data, err := os.ReadFile(filepath.Join(dir, archiveManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var entries []archiveManifestEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", archiveManifestFile, err)
+	}
+
+	var loaded []LoadedImage
+	for _, entry := range entries {
+		if len(entry.RepoTags) == 0 {
+			fmt.Printf("Skipping untagged image %s\n", entry.Config)
+			continue
+		}
+
+		layers := make([]archiveBlob, len(entry.Layers))
+		for i, layer := range entry.Layers {
+			layers[i].path, err = archivePath(dir, layer)
+			if err != nil {
+				return nil, err
+			}
+		}
+		configPath, err := archivePath(dir, entry.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tag := range entry.RepoTags {
+			ref, err := ParseReference(tag)
+			if err != nil {
+				return nil, err
+			}
+			img, err := storeImage(ref, archiveBlob{path: configPath}, layers, false, store)
+			if err != nil {
+				return nil, err
+			}
+			loaded = append(loaded, img)
+		}
+	}
+	return loaded, nil
+}
+
+// loadOCILayout imports the images of an OCI image layout, named by their annotations.
+// Every image of a nested index is imported under the name of the index.
+func loadOCILayout(dir string, store func(Reference, Platform, func(dir string) error) error) ([]LoadedImage, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ociIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index ociIndex
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", ociIndexFile, err)
+	}
+
+	var loaded []LoadedImage
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[referenceTypeAnnotation] != "" {
+			continue
+		}
+		name := descriptor.Annotations[imageNameAnnotation]
+		if name == "" {
+			name = descriptor.Annotations[refNameAnnotation]
+		}
+		// A bare ref.name is only a tag, which does not say what repository the image belongs to.
+		if name == "" || !strings.ContainsAny(name, "/:@") {
+			fmt.Printf("Skipping unnamed image %s\n", descriptor.Digest)
+			continue
+		}
+		ref, err := ParseReference(name)
+		if err != nil {
+			return nil, err
+		}
+
+		images, err := loadOCIDescriptor(dir, ref, descriptor, store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", ref, err)
+		}
+		loaded = append(loaded, images...)
+	}
+	return loaded, nil
+}
+
+// loadOCIDescriptor imports the image a descriptor of an OCI layout points to, or every image of an index
+// but the attestations and other manifests attached to them.
+func loadOCIDescriptor(dir string, ref Reference, descriptor ociDescriptor, store func(Reference, Platform, func(dir string) error) error) ([]LoadedImage, error) {
+	raw, err := readLayoutBlob(dir, descriptor.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	switch descriptor.MediaType {
+	case ociIndexMediaType, dockerManifestListMediaType:
+		var index ociIndex
+		err := json.Unmarshal(raw, &index)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode index %s: %w", descriptor.Digest, err)
+		}
+
+		var loaded []LoadedImage
+		for _, child := range index.Manifests {
+			if child.Annotations[referenceTypeAnnotation] != "" {
+				continue
+			}
+			images, err := loadOCIDescriptor(dir, ref, child, store)
+			if err != nil {
+				return nil, err
+			}
+			loaded = append(loaded, images...)
+		}
+		return loaded, nil
+	case ociManifestMediaType, dockerManifestMediaType:
+		var manifest Manifest
+		err := json.Unmarshal(raw, &manifest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode manifest %s: %w", descriptor.Digest, err)
+		}
+
+		config := archiveBlob{digest: manifest.Config.Digest}
+		config.path, err = layoutBlobPath(dir, manifest.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layers := make([]archiveBlob, len(manifest.Layers))
+		for i, layer := range manifest.Layers {
+			layers[i].digest = layer.Digest
+			layers[i].path, err = layoutBlobPath(dir, layer.Digest)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		img, err := storeImage(ref, config, layers, descriptor.MediaType == ociManifestMediaType, store)
+		if err != nil {
+			return nil, err
+		}
+		return []LoadedImage{img}, nil
+	default:
+		return nil, fmt.Errorf("unsupported media type %q for %s", descriptor.MediaType, descriptor.Digest)
+	}
+}
+
+// readLayoutBlob reads a blob of an OCI layout and verifies its digest.
+func readLayoutBlob(dir, digest string) ([]byte, error) {
+	blob, err := layoutBlobPath(dir, digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", digest, err)
+	}
+	err = verifyDigest(digest, data)
+	if err != nil {
+		return nil, fmt.Errorf("blob %s: %w", digest, err)
+	}
+	return data, nil
+}
+
+// layoutBlobPath returns the path of a blob in an OCI layout, blobs/<algorithm>/<hex>.
+func layoutBlobPath(dir, digest string) (string, error) {
+	_, err := newVerifier(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, blobPath(digest)), nil
+}
+
+// archivePath resolves a path listed in the manifest.json of a docker save tarball.
+func archivePath(dir, name string) (string, error) {
+	name = path.Clean(name)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid path in %s: %s", archiveManifestFile, name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// storeImage writes an image into the layer store through store and creates the manifest describing it there,
+// an OCI one or a Docker one matching the archive it came from.
+func storeImage(ref Reference, config archiveBlob, layers []archiveBlob, oci bool, store func(Reference, Platform, func(dir string) error) error) (LoadedImage, error) {
+	rawConfig, err := os.ReadFile(config.path)
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("failed to read image config: %w", err)
+	}
+	if config.digest != "" {
+		err = verifyDigest(config.digest, rawConfig)
+		if err != nil {
+			return LoadedImage{}, fmt.Errorf("image config %s: %w", config.digest, err)
+		}
+	}
+	var imageConfig ImageConfig
+	err = json.Unmarshal(rawConfig, &imageConfig)
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("failed to decode image config: %w", err)
+	}
+	platform := NormalizePlatform(Platform{OS: imageConfig.OS, Architecture: imageConfig.Architecture, Variant: imageConfig.Variant})
+
+	fmt.Printf("Loading %s (%s) with %d layers\n", ref, platform, len(layers))
+	err = store(ref, platform, func(dir string) error {
+		manifest := Manifest{
+			SchemaVersion: 2,
+			MediaType:     dockerManifestMediaType,
+			Config:        Layer{MediaType: dockerConfigMediaType, Digest: sha256Digest(rawConfig), Size: int64(len(rawConfig))},
+			Layers:        []Layer{},
+		}
+		if oci {
+			manifest.MediaType = ociManifestMediaType
+			manifest.Config.MediaType = ociConfigMediaType
+		}
+
+		for _, blob := range layers {
+			layer, err := storeLayer(blob, dir, oci)
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, layer)
+		}
+
+		err := writeFileAtomic(filepath.Join(dir, ConfigFileName), rawConfig)
+		if err != nil {
+			return err
+		}
+		rawManifest, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(filepath.Join(dir, ManifestFileName), rawManifest)
+	})
+	if err != nil {
+		return LoadedImage{}, err
+	}
+	return LoadedImage{Reference: ref, Platform: platform}, nil
+}
+
+// storeLayer copies a layer into dir under the name derived from its descriptor and returns the descriptor,
+// verifying the blob against the digest of the archive if it has one.
+// The media type follows the compression found in the blob, gzip, zstd or none, in the Docker or OCI flavour.
+func storeLayer(blob archiveBlob, dir string, oci bool) (Layer, error) {
+	src := blob.path
+	file, err := os.Open(src)
+	if err != nil {
+		return Layer{}, fmt.Errorf("failed to open layer: %w", err)
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return Layer{}, fmt.Errorf("failed to read layer %s: %w", src, err)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return Layer{}, err
+	}
+
+	layer := Layer{MediaType: layerMediaTypes[oci][DetectCompression(magic[:n])]}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return Layer{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	writer := io.MultiWriter(tmp, h)
+	var v *verifier
+	if blob.digest != "" {
+		v, err = newVerifier(blob.digest)
+		if err != nil {
+			return Layer{}, err
+		}
+		writer = io.MultiWriter(writer, v)
+	}
+	layer.Size, err = io.Copy(writer, file)
+	if err != nil {
+		return Layer{}, fmt.Errorf("failed to store layer %s: %w", src, err)
+	}
+	if v != nil {
+		err = v.Verify()
+		if err != nil {
+			return Layer{}, fmt.Errorf("layer %s: %w", blob.digest, err)
+		}
+	}
+	err = tmp.Close()
+	if err != nil {
+		return Layer{}, err
+	}
+
+	layer.Digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	err = os.Rename(tmp.Name(), LayerPath(dir, layer))
+	if err != nil {
+		return Layer{}, err
+	}
+	return layer, nil
+}
+
+// blobPath returns the path of a blob in an image layout, blobs/<algorithm>/<hex>.
+func blobPath(digest string) string {
+	algorithm, encoded, _ := strings.Cut(digest, ":")
+	return path.Join("blobs", algorithm, encoded)
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// copyFile copies the content of src to a new file at dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
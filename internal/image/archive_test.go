@@ -0,0 +1,141 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeLayout writes an OCI layout holding an image with one layer, named registry.example/app:v1, and an
+// attestation manifest attached to it, and returns the layout directory and the path of the layer blob.
+func writeLayout(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	writeBlob := func(data []byte) string {
+		digest := sha256Digest(data)
+		blob := filepath.Join(dir, blobPath(digest))
+		err := os.MkdirAll(filepath.Dir(blob), 0o755)
+		if err == nil {
+			err = os.WriteFile(blob, data, 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+	writeJSON := func(v any) (string, int64) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writeBlob(data), int64(len(data))
+	}
+
+	layer := []byte("layer content")
+	config := []byte(`{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers"}}`)
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        Layer{MediaType: ociConfigMediaType, Digest: writeBlob(config), Size: int64(len(config))},
+		Layers:        []Layer{{MediaType: layerMediaTypes[true][Uncompressed], Digest: writeBlob(layer), Size: int64(len(layer))}},
+	}
+	manifestDigest, manifestSize := writeJSON(manifest)
+	attestation := Manifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        Layer{MediaType: "application/vnd.in-toto+json", Digest: writeBlob([]byte("{}")), Size: 2},
+		Layers:        []Layer{},
+	}
+	attestationDigest, attestationSize := writeJSON(attestation)
+
+	index := ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []ociDescriptor{
+		{MediaType: ociManifestMediaType, Digest: manifestDigest, Size: manifestSize},
+		{
+			MediaType:   ociManifestMediaType,
+			Digest:      attestationDigest,
+			Size:        attestationSize,
+			Annotations: map[string]string{referenceTypeAnnotation: "attestation-manifest"},
+		},
+	}}
+	indexDigest, indexSize := writeJSON(index)
+
+	top := ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{{
+		MediaType:   ociIndexMediaType,
+		Digest:      indexDigest,
+		Size:        indexSize,
+		Annotations: map[string]string{imageNameAnnotation: "registry.example/app:v1"},
+	}}}
+	data, err := json.Marshal(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, ociIndexFile), data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, filepath.Join(dir, blobPath(manifest.Layers[0].Digest))
+}
+
+// directoryStore returns a store function for LoadImages writing every image into a new directory and
+// appending it to dirs.
+func directoryStore(t *testing.T, dirs *[]string) func(Reference, Platform, func(string) error) error {
+	return func(ref Reference, platform Platform, write func(string) error) error {
+		dir := t.TempDir()
+		err := write(dir)
+		if err != nil {
+			return err
+		}
+		*dirs = append(*dirs, dir)
+		return nil
+	}
+}
+
+func TestLoadOCILayoutSkipsAttestations(t *testing.T) {
+	layout, _ := writeLayout(t)
+
+	var dirs []string
+	loaded, err := LoadImages(layout, nil, directoryStore(t, &dirs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || loaded[0].Reference.String() != "registry.example/app:v1" {
+		t.Fatalf("loaded %+v, want only registry.example/app:v1", loaded)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dirs[0], ManifestFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("stored manifest has %d layers, want 1", len(manifest.Layers))
+	}
+	_, err = os.Stat(LayerPath(dirs[0], manifest.Layers[0]))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadOCILayoutVerifiesBlobs(t *testing.T) {
+	layout, layer := writeLayout(t)
+	err := os.WriteFile(layer, []byte("tampered content"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dirs []string
+	_, err = LoadImages(layout, nil, directoryStore(t, &dirs))
+	var mismatch *DigestMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("err = %v, want a digest mismatch", err)
+	}
+	if len(dirs) != 0 {
+		t.Errorf("%d images stored from a layout with a tampered layer", len(dirs))
+	}
+}
@@ -0,0 +1,468 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pingURL = "%s/v2/"
+
+	// defaultTokenLifetime is used when the token server does not say how long a token is valid, as in the spec.
+	defaultTokenLifetime = 60 * time.Second
+	// tokenExpiryMargin renews tokens slightly before they expire so in-flight requests do not fail.
+	tokenExpiryMargin = 5 * time.Second
+
+	clientID = "gocker"
+
+	responseHeaderTimeout = 30 * time.Second
+)
+
+// Client talks to registries implementing the OCI Distribution API.
+// It discovers how each registry authenticates by probing /v2/ and following the WWW-Authenticate
+// challenge, then authorizes every request with Basic credentials or a Bearer token scoped to the
+// repository. Tokens are cached per registry and scope and fetched again once they expire.
+// Registries configures mirrors, insecure registries and CA certificates.
+// HTTPClient and Credentials can be replaced, e.g. to point the client at an httptest registry.
+type Client struct {
+	HTTPClient  *http.Client
+	Credentials func(domain string) (Credentials, error)
+	Registries  *RegistryConfig
+
+	mu         sync.Mutex
+	challenges map[string]*challenge
+	tokens     map[string]token
+	// baseURLs overrides the API URL of a domain, for mirrors and insecure registries reached over HTTP.
+	baseURLs map[string]string
+	// httpClients holds the clients of registries with their own TLS settings.
+	httpClients map[string]*http.Client
+}
+
+// challenge is a parsed WWW-Authenticate header. A nil challenge means the registry needs no authentication.
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// NewClient returns a client using the credentials of the Docker configuration and the registry configuration.
+// Connections time out when the registry does not answer, but bodies may take as long as they need,
+// since layers can be large; callers limit them with the request context.
+func NewClient() (*Client, error) {
+	registries, err := LoadRegistryConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+
+	return &Client{
+		HTTPClient:  &http.Client{Transport: transport},
+		Credentials: LoadCredentials,
+		Registries:  registries,
+	}, nil
+}
+
+// Mirrors returns the references to try for pulling ref: those of its mirrors in the configured order,
+// then ref itself.
+func (c *Client) Mirrors(ref Reference) []Reference {
+	if c.Registries == nil {
+		return []Reference{ref}
+	}
+
+	refs, baseURLs := c.Registries.mirrorReferences(ref)
+	c.mu.Lock()
+	c.init()
+	for domain, baseURL := range baseURLs {
+		c.baseURLs[domain] = baseURL
+	}
+	c.mu.Unlock()
+	return append(refs, ref)
+}
+
+// registryURL returns the base URL of the registry API of ref to build requests with.
+// The registry is probed the first time, so the scheme of an insecure registry is settled before
+// any request to it is built.
+func (c *Client) registryURL(ctx context.Context, ref Reference) (string, error) {
+	_, err := c.challenge(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	return c.baseURL(ref), nil
+}
+
+// baseURL returns the base URL of the registry API of ref, which is the configured URL of a mirror,
+// the plain HTTP URL an insecure registry fell back to, or the default URL of the reference.
+func (c *Client) baseURL(ref Reference) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if baseURL, ok := c.baseURLs[ref.Domain]; ok {
+		return baseURL
+	}
+	return ref.registryURL()
+}
+
+// httpClient returns the HTTP client for the registry of domain, with its CA certificates or without
+// certificate verification when the registry configuration asks for it.
+func (c *Client) httpClient(domain string) (*http.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	if client, ok := c.httpClients[domain]; ok {
+		return client, nil
+	}
+
+	base, ok := c.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return c.HTTPClient, nil
+	}
+	transport, err := c.Registries.transport(base, domain)
+	if err != nil || transport == nil {
+		return c.HTTPClient, err
+	}
+
+	client := *c.HTTPClient
+	client.Transport = transport
+	c.httpClients[domain] = &client
+	return &client, nil
+}
+
+// init creates the maps of the client. The caller holds mu.
+func (c *Client) init() {
+	if c.challenges == nil {
+		c.challenges = map[string]*challenge{}
+		c.tokens = map[string]token{}
+		c.baseURLs = map[string]string{}
+		c.httpClients = map[string]*http.Client{}
+	}
+}
+
+// pullScope and pushScope return the token scopes needed to pull from and push to a repository.
+func pullScope(repository string) string {
+	return "repository:" + repository + ":pull"
+}
+
+func pushScope(repository string) string {
+	return "repository:" + repository + ":pull,push"
+}
+
+// Do sends the request to the registry of ref with the authorization needed for scope.
+// When the registry still answers 401, the cached token is dropped and the request retried once
+// with a token for the challenge it returned, provided the request body can be replayed.
+func (c *Client) Do(ref Reference, scope string, req *http.Request) (*http.Response, error) {
+	authorization, err := c.authorization(req.Context(), ref, scope)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	httpClient, err := c.httpClient(ref.Domain)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+
+	ch, ok := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	c.mu.Lock()
+	c.challenges[ref.Domain] = ch
+	delete(c.tokens, ref.Domain+" "+scope)
+	c.mu.Unlock()
+
+	if challengeScope := ch.params["scope"]; challengeScope != "" {
+		scope = challengeScope
+	}
+	authorization, err = c.authorization(req.Context(), ref, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", authorization)
+	return httpClient.Do(retry)
+}
+
+// Login checks that the credentials are accepted by the registry of the domain.
+// The client uses these credentials from then on instead of the stored ones.
+func (c *Client) Login(domain string, creds Credentials) error {
+	c.Credentials = func(string) (Credentials, error) { return creds, nil }
+
+	ref := Reference{Domain: domain}
+	registryURL, err := c.registryURL(context.Background(), ref)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(pingURL, registryURL), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(ref, "", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login to %s failed: %s", domain, resp.Status)
+	}
+	return nil
+}
+
+// authorization returns the Authorization header value for a request to the registry of ref.
+func (c *Client) authorization(ctx context.Context, ref Reference, scope string) (string, error) {
+	ch, err := c.challenge(ctx, ref)
+	if err != nil || ch == nil {
+		return "", err
+	}
+
+	creds, err := c.Credentials(ref.Domain)
+	if err != nil {
+		return "", err
+	}
+
+	switch ch.scheme {
+	case "basic":
+		if creds.Username == "" {
+			return "", nil
+		}
+		req := http.Request{Header: http.Header{}}
+		req.SetBasicAuth(creds.Username, creds.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		value, err := c.token(ctx, ref, ch, scope, creds)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + value, nil
+	default:
+		return "", fmt.Errorf("unsupported authentication scheme %q from %s", ch.scheme, ref.Domain)
+	}
+}
+
+// challenge returns the authentication challenge of the registry, probing /v2/ the first time.
+// An insecure registry that cannot be reached over HTTPS is probed again over plain HTTP,
+// which is then used for all its requests.
+func (c *Client) challenge(ctx context.Context, ref Reference) (*challenge, error) {
+	c.mu.Lock()
+	c.init()
+	ch, ok := c.challenges[ref.Domain]
+	c.mu.Unlock()
+	if ok {
+		return ch, nil
+	}
+
+	registryURL := c.baseURL(ref)
+	resp, err := c.ping(ctx, ref, registryURL)
+	if err != nil && c.Registries.insecure(ref.Domain) && strings.HasPrefix(registryURL, "https://") {
+		httpURL := "http://" + strings.TrimPrefix(registryURL, "https://")
+		resp, err = c.ping(ctx, ref, httpURL)
+		if err == nil {
+			c.mu.Lock()
+			c.baseURLs[ref.Domain] = httpURL
+			c.mu.Unlock()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach registry %s: %w", ref.Domain, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		ch = nil
+	case http.StatusUnauthorized:
+		parsed, ok := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+		if !ok {
+			return nil, fmt.Errorf("registry %s requires authentication but sent no valid challenge", ref.Domain)
+		}
+		ch = parsed
+	default:
+		return nil, fmt.Errorf("registry %s does not implement the distribution API: %s", ref.Domain, resp.Status)
+	}
+
+	c.mu.Lock()
+	c.challenges[ref.Domain] = ch
+	c.mu.Unlock()
+	return ch, nil
+}
+
+// ping sends an unauthenticated request to the /v2/ endpoint of the registry at registryURL.
+func (c *Client) ping(ctx context.Context, ref Reference, registryURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(pingURL, registryURL), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := c.httpClient(ref.Domain)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
+
+// token returns a cached bearer token for the scope or requests a new one from the realm of the challenge.
+// An identity token is exchanged with the OAuth2 refresh token grant, other credentials are sent with Basic auth.
+func (c *Client) token(ctx context.Context, ref Reference, ch *challenge, scope string, creds Credentials) (string, error) {
+	key := ref.Domain + " " + scope
+
+	c.mu.Lock()
+	cached, ok := c.tokens[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	realm := ch.params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge from %s has no realm", ref.Domain)
+	}
+
+	params := url.Values{}
+	if service := ch.params["service"]; service != "" {
+		params.Set("service", service)
+	}
+	// Several scopes, e.g. push to one repository and pull from another for a mount, are separate parameters.
+	for _, s := range strings.Fields(scope) {
+		params.Add("scope", s)
+	}
+
+	var req *http.Request
+	var err error
+	if creds.IdentityToken != "" {
+		params.Set("grant_type", "refresh_token")
+		params.Set("refresh_token", creds.IdentityToken)
+		params.Set("client_id", clientID)
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm, strings.NewReader(params.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		if creds.Username != "" {
+			params.Set("account", creds.Username)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+params.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		if creds.Username != "" {
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+	}
+
+	// The token server may be the registry itself, with the same TLS settings.
+	httpClient, err := c.httpClient(req.URL.Host)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request token from %s: %w", realm, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token request to %s failed: %s: %s", realm, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var tr tokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+
+	value := tr.Token
+	if value == "" {
+		value = tr.AccessToken
+	}
+	if value == "" {
+		return "", fmt.Errorf("token response from %s contains no token", realm)
+	}
+
+	issued := time.Now()
+	if t, err := time.Parse(time.RFC3339, tr.IssuedAt); err == nil && t.Before(issued) {
+		issued = t
+	}
+	lifetime := defaultTokenLifetime
+	if tr.ExpiresIn > 0 {
+		lifetime = time.Duration(tr.ExpiresIn) * time.Second
+	}
+
+	c.mu.Lock()
+	c.tokens[key] = token{value: value, expires: issued.Add(lifetime - tokenExpiryMargin)}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/node:pull".
+func parseChallenge(header string) (*challenge, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if scheme == "" {
+		return nil, false
+	}
+
+	ch := &challenge{scheme: strings.ToLower(scheme), params: map[string]string{}}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				return nil, false
+			}
+			ch.params[key] = value[1 : end+1]
+			value = value[end+2:]
+		} else {
+			v, _, _ := strings.Cut(value, ",")
+			ch.params[key] = strings.TrimSpace(v)
+			value = value[len(v):]
+		}
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(value), ","))
+	}
+	return ch, true
+}
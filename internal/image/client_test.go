@@ -0,0 +1,296 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testRegistry starts a TLS registry serving handler and returns a client for it and the reference of repo on it.
+func testRegistry(t *testing.T, handler http.Handler, creds Credentials) (*Client, Reference) {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	client := &Client{
+		HTTPClient:  server.Client(),
+		Credentials: func(string) (Credentials, error) { return creds, nil },
+	}
+	ref := Reference{Domain: strings.TrimPrefix(server.URL, "https://"), Repository: "library/app", Tag: "latest"}
+	return client, ref
+}
+
+// getManifest requests the manifest of ref through the client and returns the response status.
+func getManifest(t *testing.T, client *Client, ref Reference) int {
+	t.Helper()
+	registryURL, err := client.registryURL(context.Background(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, registryURL+"/v2/"+ref.Repository+"/manifests/"+ref.Tag, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(ref, pullScope(ref.Repository), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// bearerRegistry serves a registry whose token endpoint issues the tokens returned by issue,
+// checking the Basic credentials user:secret, and which accepts the tokens for which valid returns true.
+func bearerRegistry(t *testing.T, issue func() string, valid func(string) bool) http.Handler {
+	mux := http.NewServeMux()
+	challenge := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test-registry"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !valid(token) {
+			challenge(w, r)
+		}
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("service") != "test-registry" || query.Get("scope") != "repository:library/app:pull" || query.Get("account") != "user" {
+			t.Errorf("unexpected token request %s", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(tokenResponse{Token: issue(), ExpiresIn: 300})
+	})
+	return mux
+}
+
+func TestBearerChallenge(t *testing.T) {
+	var issued atomic.Int32
+	handler := bearerRegistry(t,
+		func() string { issued.Add(1); return "token-1" },
+		func(token string) bool { return token == "token-1" })
+	client, ref := testRegistry(t, handler, Credentials{Username: "user", Password: "secret"})
+
+	for range 2 {
+		status := getManifest(t, client, ref)
+		if status != http.StatusOK {
+			t.Fatalf("status = %d, want %d", status, http.StatusOK)
+		}
+	}
+	if issued.Load() != 1 {
+		t.Errorf("%d tokens issued, want 1 cached token", issued.Load())
+	}
+}
+
+func TestBearerTokenRefreshOn401(t *testing.T) {
+	// The registry revokes the first token after issuing it, so the client must drop it and fetch a new one.
+	var issued atomic.Int32
+	handler := bearerRegistry(t,
+		func() string { return fmt.Sprintf("token-%d", issued.Add(1)) },
+		func(token string) bool { return token == "token-2" })
+	client, ref := testRegistry(t, handler, Credentials{Username: "user", Password: "secret"})
+
+	status := getManifest(t, client, ref)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if issued.Load() != 2 {
+		t.Errorf("%d tokens issued, want 2", issued.Load())
+	}
+}
+
+func TestBearerChallengeWrongCredentials(t *testing.T) {
+	handler := bearerRegistry(t, func() string { return "token-1" }, func(string) bool { return true })
+	client, ref := testRegistry(t, handler, Credentials{Username: "user", Password: "wrong"})
+
+	registryURL, err := client.registryURL(context.Background(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, registryURL+"/v2/library/app/manifests/latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Do(ref, pullScope(ref.Repository), req)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("err = %v, want a failed token request", err)
+	}
+}
+
+func TestBasicChallenge(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test-registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		creds Credentials
+		want  int
+	}{
+		{"valid credentials", Credentials{Username: "user", Password: "secret"}, http.StatusOK},
+		{"wrong password", Credentials{Username: "user", Password: "wrong"}, http.StatusUnauthorized},
+		{"anonymous", Credentials{}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, ref := testRegistry(t, handler, tt.creds)
+			status := getManifest(t, client, ref)
+			if status != tt.want {
+				t.Errorf("status = %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{
+			`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/node:pull"`,
+			"bearer",
+			map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/node:pull"},
+		},
+		{`Basic realm="Registry Realm"`, "basic", map[string]string{"realm": "Registry Realm"}},
+		{`Bearer realm=https://auth.example/token, service=registry`, "bearer", map[string]string{"realm": "https://auth.example/token", "service": "registry"}},
+	}
+	for _, tt := range tests {
+		ch, ok := parseChallenge(tt.header)
+		if !ok {
+			t.Errorf("parseChallenge(%q) failed", tt.header)
+			continue
+		}
+		if ch.scheme != tt.scheme || fmt.Sprint(ch.params) != fmt.Sprint(tt.params) {
+			t.Errorf("parseChallenge(%q) = %s %v, want %s %v", tt.header, ch.scheme, ch.params, tt.scheme, tt.params)
+		}
+	}
+}
+
+// writeHelper installs a docker-credential-test helper on the PATH that answers get with output
+// for the server registry.example and reports that it has no credentials for any other server.
+func writeHelper(t *testing.T, output string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := fmt.Sprintf(`#!/bin/sh
+read server
+if [ "$1" = get ] && [ "$server" = registry.example ]; then
+	echo '%s'
+	exit 0
+fi
+echo "credentials not found in native keychain"
+exit 1
+`, output)
+	err := os.WriteFile(filepath.Join(dir, credHelperPrefix+"test"), []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// writeDockerConfig points $DOCKER_CONFIG at a directory holding a config.json with the given content.
+func writeDockerConfig(t *testing.T, content string) {
+	t.Helper()
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, configFileName), []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOCKER_CONFIG", dir)
+}
+
+func TestLoadCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		helper string
+		domain string
+		want   Credentials
+	}{
+		{
+			name:   "credential helper for the registry",
+			config: `{"credHelpers": {"registry.example": "test"}}`,
+			helper: `{"ServerURL": "registry.example", "Username": "user", "Secret": "secret"}`,
+			domain: "registry.example",
+			want:   Credentials{Username: "user", Password: "secret"},
+		},
+		{
+			name:   "credential store returning an identity token",
+			config: `{"credsStore": "test"}`,
+			helper: `{"ServerURL": "registry.example", "Username": "<token>", "Secret": "refresh"}`,
+			domain: "registry.example",
+			want:   Credentials{IdentityToken: "refresh"},
+		},
+		{
+			name:   "credential helper without credentials",
+			config: `{"credsStore": "test"}`,
+			domain: "other.example",
+			want:   Credentials{},
+		},
+		{
+			name:   "inline auth keyed by URL",
+			config: `{"auths": {"https://registry.example/v1/": {"auth": "dXNlcjpzZWNyZXQ="}}}`,
+			domain: "registry.example",
+			want:   Credentials{Username: "user", Password: "secret"},
+		},
+		{
+			name:   "helper of another registry",
+			config: `{"credHelpers": {"other.example": "test"}, "auths": {"registry.example": {"identitytoken": "refresh"}}}`,
+			domain: "registry.example",
+			want:   Credentials{IdentityToken: "refresh"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeDockerConfig(t, tt.config)
+			writeHelper(t, tt.helper)
+
+			creds, err := LoadCredentials(tt.domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if creds != tt.want {
+				t.Errorf("LoadCredentials(%q) = %+v, want %+v", tt.domain, creds, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentityTokenExchange(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test-registry"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" {
+			http.Error(w, "bad grant", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "access"})
+	})
+	client, ref := testRegistry(t, mux, Credentials{IdentityToken: "refresh"})
+
+	status := getManifest(t, client, ref)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+}
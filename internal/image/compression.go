@@ -0,0 +1,64 @@
+package image
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Compression is the compression of a layer blob.
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressionSuffixes map the endings of layer media types to their compression: OCI media types end in
+// +gzip or +zstd, Docker ones in .tar.gzip or .tar.zstd, and uncompressed layers of both in tar.
+var compressionSuffixes = map[string]Compression{
+	"+gzip": Gzip,
+	".gzip": Gzip,
+	"+zstd": Zstd,
+	".zstd": Zstd,
+	".tar":  Uncompressed,
+}
+
+// compressionExtensions are the file extensions layers are stored with in the layer store.
+var compressionExtensions = map[Compression]string{
+	Uncompressed: ".tar",
+	Gzip:         ".tar.gz",
+	Zstd:         ".tar.zst",
+}
+
+// String returns the name of the compression.
+func (c Compression) String() string {
+	return map[Compression]string{Uncompressed: "uncompressed", Gzip: "gzip", Zstd: "zstd"}[c]
+}
+
+// MediaTypeCompression returns the compression a layer media type declares; ok is false for unknown media types.
+func MediaTypeCompression(mediaType string) (Compression, bool) {
+	for suffix, compression := range compressionSuffixes {
+		if strings.HasSuffix(mediaType, suffix) {
+			return compression, true
+		}
+	}
+	return Uncompressed, false
+}
+
+// DetectCompression identifies the compression of a blob from its first bytes; anything else is taken for a tar.
+func DetectCompression(header []byte) Compression {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return Zstd
+	default:
+		return Uncompressed
+	}
+}
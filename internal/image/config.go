@@ -0,0 +1,167 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// ConfigFileName and ManifestFileName are the names of the image configuration and manifest
+	// stored next to the downloaded layers.
+	ConfigFileName   = "config.json"
+	ManifestFileName = "manifest.json"
+)
+
+// ImageConfig is the OCI image configuration, the blob referenced by the config descriptor of a manifest.
+// Docker's image config is a superset of it, so both decode into this type.
+type ImageConfig struct {
+	Created      string          `json:"created,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	OSVersion    string          `json:"os.version,omitempty"`
+	Variant      string          `json:"variant,omitempty"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       RootFS          `json:"rootfs"`
+	History      []History       `json:"history,omitempty"`
+}
+
+// ContainerConfig holds the defaults a container of the image runs with.
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+// RootFS lists the digests of the uncompressed layers, in order from the bottom layer.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// History describes how a layer was created.
+type History struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// LoadConfig reads the image configuration that DownloadImage stored in a layer directory.
+func LoadConfig(dir string) (ImageConfig, error) {
+	var config ImageConfig
+	data, err := os.ReadFile(filepath.Join(dir, ConfigFileName))
+	if err != nil {
+		return ImageConfig{}, fmt.Errorf("failed to read image config: %w", err)
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return ImageConfig{}, fmt.Errorf("failed to decode image config: %w", err)
+	}
+	return config, nil
+}
+
+// LoadManifest reads the manifest that DownloadImage stored in a layer directory.
+// Its layers are listed in the order they apply, from the bottom layer.
+func LoadManifest(dir string) (Manifest, error) {
+	manifest, _, err := readStoredManifest(dir)
+	return manifest, err
+}
+
+// readStoredManifest reads the manifest DownloadImage stored in dir, along with its raw bytes.
+func readStoredManifest(dir string) (Manifest, []byte, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return Manifest{}, nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest Manifest
+	err = json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return Manifest{}, nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = ociManifestMediaType
+	}
+	return manifest, raw, nil
+}
+
+// LayerPath returns the path of the file a layer of the manifest is stored in, in a layer directory.
+func LayerPath(dir string, layer Layer) string {
+	return filepath.Join(dir, layerFilename(layer))
+}
+
+// downloadConfig fetches the config blob of the manifest, verifies its digest and stores it as config.json in dest.
+func downloadConfig(ctx context.Context, client *Client, ref Reference, descriptor Layer, dest string) (ImageConfig, error) {
+	registryURL, err := client.registryURL(ctx, ref)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	url := fmt.Sprintf(blobURL, registryURL, ref.Repository, descriptor.Digest)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+
+	response, err := client.Do(ref, pullScope(ref.Repository), req)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	err = checkResponse(response)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return ImageConfig{}, fmt.Errorf("failed to read image config of %s: %w", ref, err)
+	}
+	err = verifyDigest(descriptor.Digest, data)
+	if err != nil {
+		return ImageConfig{}, fmt.Errorf("image config of %s: %w", ref, err)
+	}
+
+	var config ImageConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return ImageConfig{}, fmt.Errorf("failed to decode image config of %s: %w", ref, err)
+	}
+
+	err = writeFileAtomic(filepath.Join(dest, ConfigFileName), data)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	return config, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
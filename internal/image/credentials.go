@@ -0,0 +1,279 @@
+package image
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dockerHubConfigKey = "https://index.docker.io/v1/"
+	configFileName     = "config.json"
+	credHelperPrefix   = "docker-credential-"
+
+	// identityTokenUser is the user name credential helpers return along with an identity token.
+	identityTokenUser = "<token>"
+)
+
+// Credentials authenticate against a registry either with a user name and password
+// or with an identity token, which is an OAuth2 refresh token.
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+type authEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+type credHelperPayload struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// dockerConfig is the subset of ~/.docker/config.json used for registry credentials.
+// The file is shared with Docker, so every other field is kept untouched in raw.
+type dockerConfig struct {
+	Auths       map[string]authEntry `json:"auths,omitempty"`
+	CredsStore  string               `json:"credsStore,omitempty"`
+	CredHelpers map[string]string    `json:"credHelpers,omitempty"`
+
+	raw map[string]json.RawMessage
+}
+
+// configPath returns the path of the Docker configuration file, honouring $DOCKER_CONFIG.
+func configPath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, configFileName), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".docker", configFileName), nil
+}
+
+// loadDockerConfig reads the Docker configuration file. A missing file is an empty configuration.
+func loadDockerConfig() (*dockerConfig, error) {
+	config := &dockerConfig{raw: map[string]json.RawMessage{}}
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	err = json.Unmarshal(data, &config.raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// save writes the configuration back, keeping the fields gocker does not know about.
+func (c *dockerConfig) save() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	auths, err := json.Marshal(c.Auths)
+	if err != nil {
+		return fmt.Errorf("failed to encode credentials: %w", err)
+	}
+	c.raw["auths"] = auths
+
+	data, err := json.MarshalIndent(c.raw, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", path, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// helper returns the credential helper configured for the registry, if any.
+func (c *dockerConfig) helper(domain string) string {
+	for key, helper := range c.CredHelpers {
+		if normalizeConfigKey(key) == domain {
+			return helper
+		}
+	}
+	return c.CredsStore
+}
+
+// LoadCredentials returns the credentials stored for a registry domain in the Docker configuration,
+// either inline in "auths" or through the configured credential helper.
+// Empty credentials are returned when none are stored, so the registry is accessed anonymously.
+func LoadCredentials(domain string) (Credentials, error) {
+	config, err := loadDockerConfig()
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	if helper := config.helper(domain); helper != "" {
+		return helperGet(helper, configKey(domain))
+	}
+
+	for key, entry := range config.Auths {
+		if normalizeConfigKey(key) != domain {
+			continue
+		}
+
+		creds := Credentials{IdentityToken: entry.IdentityToken}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return Credentials{}, fmt.Errorf("invalid auth entry for %s: %w", key, err)
+			}
+			creds.Username, creds.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		return creds, nil
+	}
+	return Credentials{}, nil
+}
+
+// SaveCredentials stores the credentials for a registry domain, in the credential helper when one is configured
+// and otherwise base64 encoded in the "auths" section of the Docker configuration.
+func SaveCredentials(domain string, creds Credentials) error {
+	config, err := loadDockerConfig()
+	if err != nil {
+		return err
+	}
+
+	if helper := config.helper(domain); helper != "" {
+		payload := credHelperPayload{ServerURL: configKey(domain), Username: creds.Username, Secret: creds.Password}
+		if creds.IdentityToken != "" {
+			payload.Username, payload.Secret = identityTokenUser, creds.IdentityToken
+		}
+		input, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		_, err = runHelper(helper, "store", input)
+		return err
+	}
+
+	if config.Auths == nil {
+		config.Auths = map[string]authEntry{}
+	}
+	entry := authEntry{IdentityToken: creds.IdentityToken}
+	if creds.Username != "" {
+		entry.Auth = base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+	}
+	config.Auths[configKey(domain)] = entry
+	return config.save()
+}
+
+// RemoveCredentials deletes the credentials stored for a registry domain.
+func RemoveCredentials(domain string) error {
+	config, err := loadDockerConfig()
+	if err != nil {
+		return err
+	}
+
+	if helper := config.helper(domain); helper != "" {
+		_, err := runHelper(helper, "erase", []byte(configKey(domain)))
+		return err
+	}
+
+	found := false
+	for key := range config.Auths {
+		if normalizeConfigKey(key) == domain {
+			delete(config.Auths, key)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("not logged in to %s", domain)
+	}
+	return config.save()
+}
+
+// helperGet asks a credential helper for the credentials of a server.
+// A helper reporting that it has no credentials is not an error.
+func helperGet(helper, serverURL string) (Credentials, error) {
+	output, err := runHelper(helper, "get", []byte(serverURL))
+	if err != nil {
+		if strings.Contains(err.Error(), "credentials not found") {
+			return Credentials{}, nil
+		}
+		return Credentials{}, err
+	}
+
+	var payload credHelperPayload
+	err = json.Unmarshal(output, &payload)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("invalid output from %s%s: %w", credHelperPrefix, helper, err)
+	}
+
+	if payload.Username == identityTokenUser {
+		return Credentials{IdentityToken: payload.Secret}, nil
+	}
+	return Credentials{Username: payload.Username, Password: payload.Secret}, nil
+}
+
+// runHelper runs a docker-credential-<helper> program with the given action and standard input.
+func runHelper(helper, action string, input []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(credHelperPrefix+helper, action)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		return nil, fmt.Errorf("%s%s %s failed: %s: %w", credHelperPrefix, helper, action, message, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// RegistryDomain converts a server given on the command line, such as https://index.docker.io/v1/,
+// to the registry domain credentials are stored for. An empty server means Docker Hub.
+func RegistryDomain(server string) string {
+	if server == "" {
+		return dockerHubDomain
+	}
+	return normalizeConfigKey(server)
+}
+
+// configKey returns the key Docker uses for a registry domain in its configuration.
+func configKey(domain string) string {
+	if domain == dockerHubDomain {
+		return dockerHubConfigKey
+	}
+	return domain
+}
+
+// normalizeConfigKey converts a configuration key, which may be a URL, back to a registry domain.
+func normalizeConfigKey(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key, _, _ = strings.Cut(key, "/")
+	if key == "index.docker.io" || key == dockerHubRegistry {
+		return dockerHubDomain
+	}
+	return key
+}
@@ -0,0 +1,62 @@
+package image
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// digestAlgorithms are the hash functions content digests may use.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// verifier hashes content as it is written and checks it against the expected digest.
+type verifier struct {
+	hash.Hash
+	algorithm string
+	expected  string
+}
+
+// newVerifier returns a verifier for a digest in the algorithm:hex form.
+func newVerifier(digest string) (*verifier, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	newHash, known := digestAlgorithms[algorithm]
+	if !ok || !known {
+		return nil, fmt.Errorf("unsupported digest %q", digest)
+	}
+
+	h := newHash()
+	if len(encoded) != hex.EncodedLen(h.Size()) {
+		return nil, fmt.Errorf("invalid digest %q", digest)
+	}
+	return &verifier{Hash: h, algorithm: algorithm, expected: digest}, nil
+}
+
+// Digest returns the digest of everything written so far.
+func (v *verifier) Digest() string {
+	return v.algorithm + ":" + hex.EncodeToString(v.Sum(nil))
+}
+
+// Verify returns a DigestMismatchError unless the content written matches the expected digest.
+func (v *verifier) Verify() error {
+	actual := v.Digest()
+	if actual != v.expected {
+		return &DigestMismatchError{Expected: v.expected, Actual: actual}
+	}
+	return nil
+}
+
+// verifyDigest checks complete content against a digest.
+func verifyDigest(digest string, data []byte) error {
+	v, err := newVerifier(digest)
+	if err != nil {
+		return err
+	}
+	v.Write(data)
+	return v.Verify()
+}
@@ -1,211 +1,559 @@
 package image
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	authURL                   = "https://auth.docker.io/token?service=registry.docker.io&scope=repository:%s:pull"
-	dockerManifestUrl         = "https://registry-1.docker.io/v2/%s/manifests/%s"
-	dockerManifestByDigestURL = "https://registry-1.docker.io/v2/%s/manifests/%s"
+	manifestURL = "%s/v2/%s/manifests/%s"
+	blobURL     = "%s/v2/%s/blobs/%s"
 
-	dockerImageUrl    = "https://registry-1.docker.io/v2/%s/blobs/%s"
-	manifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
-	fileExt           = ".tar.gz"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	ociIndexMediaType           = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType        = "application/vnd.oci.image.manifest.v1+json"
+	partialExt                  = ".partial"
+
+	// DefaultMaxConcurrentDownloads matches the default of the Docker daemon.
+	DefaultMaxConcurrentDownloads = 3
+
+	maxDownloadAttempts = 5
+	initialRetryDelay   = time.Second
+	stallTimeout        = time.Minute
 )
 
-// STRUCTS
-type AuthResponse struct {
-	Token string `json:"token"`
+// manifestMediaTypes are the media types accepted for manifests, preferring multi-platform lists.
+var manifestMediaTypes = []string{
+	dockerManifestListMediaType,
+	ociIndexMediaType,
+	dockerManifestMediaType,
+	ociManifestMediaType,
 }
 
+// STRUCTS
 type Layer struct {
-	Digest string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
 }
 
 type Manifest struct {
-	Layers []Layer `json:"layers"`
+	SchemaVersion int     `json:"schemaVersion,omitempty"`
+	MediaType     string  `json:"mediaType"`
+	Config        Layer   `json:"config"`
+	Layers        []Layer `json:"layers"`
 }
 
 type ManifestList struct {
+	MediaType string               `json:"mediaType"`
 	Manifests []PlatformDescriptor `json:"manifests"`
 }
 
 type PlatformDescriptor struct {
-	Digest   string   `json:"digest"`
-	Platform Platform `json:"platform"`
+	MediaType string   `json:"mediaType"`
+	Digest    string   `json:"digest"`
+	Platform  Platform `json:"platform"`
 }
 
-type Platform struct {
-	Architecture string `json:"architecture"`
-	OS           string `json:"os"`
+// DownloadOptions configures how DownloadImage fetches layers.
+type DownloadOptions struct {
+	// MaxConcurrentDownloads limits how many layers are downloaded at once; zero means DefaultMaxConcurrentDownloads.
+	MaxConcurrentDownloads int
+	// Progress receives the per-layer progress; nil means standard output.
+	Progress io.Writer
+	// Platform selects the image from a multi-platform image; the zero value means the host platform.
+	Platform Platform
+	// Apply, when set, receives the layers in manifest order while they are still downloading, e.g. to extract
+	// them into a root filesystem. The reader returns the blob as it arrives and ends once its digest is verified,
+	// and a layer is only complete once Apply returns.
+	Apply func(layer Layer, r io.Reader) error
+	// DiscardLayers removes every layer blob once applied instead of keeping it for save and push. The blobs are
+	// still written to disk while they download, as Apply reads them from there.
+	DiscardLayers bool
 }
 
-// DownloadImage downloads a Docker image by its name and tag.
-// It retrieves the authentication token, fetches the image manifest,
-// and downloads each layer of the image to the specified destination directory.
-// The image is identified by its name and tag, and the layers are saved as files
-// in the destination directory with filenames derived from their digests.
-// It returns an error if any step fails, such as authentication, manifest retrieval, or layer
-func DownloadImage(imageName string, tag string, dest string) error {
-	auth, err := authenticate(imageName)
+// DownloadImage downloads an image from the registry its reference points to.
+// It authenticates with the registry as needed, fetches the image manifest,
+// stores the image configuration as config.json and downloads the layers of the image concurrently
+// to the specified destination directory, followed by the manifest as manifest.json.
+// The layers are saved as files in the destination directory with filenames derived from their digests;
+// interrupted downloads are resumed and transient failures retried with backoff.
+// The first failing layer cancels the others, as does cancelling ctx.
+// The configured mirrors of the registry are tried in order before the registry itself;
+// layers already downloaded from a failing mirror are kept, since they are verified by digest.
+//
+// With opts.Apply, layers are streamed to the applier in order while all of them download in parallel:
+// the applier follows each layer as it is written to disk, and its compressed blob is removed afterwards
+// when opts.DiscardLayers is set.
+func DownloadImage(ctx context.Context, ref Reference, dest string, opts DownloadOptions) error {
+	client, err := NewClient()
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Using authentication token for image %s\n", imageName)
-	digest, err := selectPlatformDigest(imageName, tag, auth)
+	candidates := client.Mirrors(ref)
+	for i, candidate := range candidates {
+		var applied bool
+		applied, err = downloadFrom(ctx, client, candidate, dest, opts)
+		// Layers already applied cannot be taken back, so a failure once the applier received data ends the pull.
+		if err == nil || ctx.Err() != nil || applied || i == len(candidates)-1 {
+			break
+		}
+		fmt.Printf("Pulling %s from mirror %s failed, trying the next source: %v\n", ref, candidate.Domain, err)
+	}
+	return err
+}
+
+// downloadFrom downloads the image from a single registry.
+func downloadFrom(ctx context.Context, client *Client, ref Reference, dest string, opts DownloadOptions) (bool, error) {
+	platform := opts.Platform
+	if platform.OS == "" {
+		platform = DefaultPlatform()
+	}
+
+	manifest, rawManifest, err := fetchManifest(ctx, client, ref, ref.Identifier(), platform)
 	if err != nil {
-		return err
+		return false, err
 	}
+	fmt.Printf("Fetched manifest for image %s with %d layers\n", ref, len(manifest.Layers))
 
-	fmt.Printf("Selected digest for image %s: %s\n", imageName, digest)
-	manifest, err := fetchManifest(imageName, digest, auth)
+	_, err = downloadConfig(ctx, client, ref, manifest.Config, dest)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	limit := opts.MaxConcurrentDownloads
+	if limit <= 0 {
+		limit = DefaultMaxConcurrentDownloads
+	}
+	out := opts.Progress
+	if out == nil {
+		out = os.Stdout
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p := newProgress(out, manifest.Layers)
+	semaphore := make(chan struct{}, limit)
+	errs := make([]error, len(manifest.Layers))
+	streams := make([]*layerStream, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		if opts.Apply != nil {
+			streams[i] = newLayerStream(ctx, partialLayerPath(dest, layer), LayerPath(dest, layer))
+		}
 	}
-	fmt.Printf("Fetched manifest for image %s with %d layers\n", imageName, len(manifest.Layers))
 
+	var wg sync.WaitGroup
 	for i, layer := range manifest.Layers {
-		fmt.Printf("Downloading layer %d/%d: %s\n", i+1, len(manifest.Layers), layer.Digest)
-		err := downloadLayer(layer.Digest, imageName, auth, dest)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+				errs[i] = downloadLayer(ctx, client, ref, layer, dest, p, i, streams[i])
+				<-semaphore
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+			}
+
+			if streams[i] != nil {
+				streams[i].finish(errs[i])
+			}
+			if errs[i] != nil {
+				p.setStatus(i, "Download failed")
+				cancel()
+			}
+		}()
+	}
+
+	var applied bool
+	var applyErr error
+	if opts.Apply != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			applied, applyErr = applyLayers(manifest.Layers, streams, opts, p)
+			if applyErr != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	p.stop()
+
+	// Report the error that caused the cancellation rather than the cancellations it triggered.
+	errs = append(errs, applyErr)
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return applied, err
+		}
+	}
+	for _, err := range errs {
 		if err != nil {
-			return err
+			return applied, err
 		}
 	}
 
-	fmt.Printf("Downloaded all layers for image %s to %s\n", imageName, dest)
-	return nil
+	// The manifest is written last, so its presence marks a complete download.
+	err = writeFileAtomic(filepath.Join(dest, ManifestFileName), rawManifest)
+	if err != nil {
+		return applied, err
+	}
+
+	fmt.Printf("Downloaded all layers for image %s to %s\n", ref, dest)
+	return applied, nil
 }
 
-// authenticate retrieves an authentication token for the Docker registry.
-// It uses the Docker Hub API to get a token that can be used to pull images.
-// The token is scoped to the specified image name for pulling.
-// It returns the token as a string or an error if the request fails.
-func authenticate(imageName string) (string, error) {
-	url := fmt.Sprintf(authURL, imageName)
-	response, err := http.Get(url)
+// applyLayers hands the layers to opts.Apply in manifest order, each as soon as its download starts writing it.
+// A layer is applied once the applier returned and its download was verified; its blob is then removed
+// when opts.DiscardLayers is set.
+// It reports whether the applier received any data, after which the pull cannot be retried from another source.
+func applyLayers(layers []Layer, streams []*layerStream, opts DownloadOptions, p *progress) (bool, error) {
+	applied := false
+	for i, layer := range layers {
+		err := opts.Apply(layer, streams[i])
+		streams[i].Close()
+		applied = applied || streams[i].read
+		if err != nil {
+			p.setStatus(i, "Extraction failed")
+			return applied, fmt.Errorf("failed to apply layer %s: %w", layer.Digest, err)
+		}
+
+		// The applier may stop at the end of the tar archive, before the end of the blob and its verification.
+		err = streams[i].wait()
+		if err != nil {
+			return applied, err
+		}
+		p.setStatus(i, "Pull complete")
+
+		if opts.DiscardLayers {
+			err = os.Remove(streams[i].finalPath)
+			if err != nil {
+				return applied, err
+			}
+		}
+	}
+	return applied, nil
+}
+
+// fetchManifest retrieves the image manifest for a tag or digest of the repository.
+// All Docker and OCI manifest media types are accepted and the response is handled by its Content-Type:
+// a Docker manifest list or OCI index is resolved to the manifest of the requested platform,
+// while a single-platform image returns its manifest directly.
+// The manifest is returned both decoded and as the exact bytes its digest was computed over.
+func fetchManifest(ctx context.Context, client *Client, ref Reference, identifier string, platform Platform) (Manifest, []byte, error) {
+	body, mediaType, err := fetchManifestBody(ctx, client, ref, identifier)
 	if err != nil {
-		return "", err
+		return Manifest{}, nil, err
 	}
 
-	defer response.Body.Close()
+	switch mediaType {
+	case dockerManifestListMediaType, ociIndexMediaType:
+		var manifestList ManifestList
+		err := json.Unmarshal(body, &manifestList)
+		if err != nil {
+			return Manifest{}, nil, fmt.Errorf("failed to decode manifest list of %s: %w", ref, err)
+		}
 
-	var authResponse AuthResponse
+		digest, err := selectPlatformDigest(manifestList, platform)
+		if err != nil {
+			return Manifest{}, nil, err
+		}
+		fmt.Printf("Selected digest for image %s: %s\n", ref, digest)
 
-	err = json.NewDecoder(response.Body).Decode(&authResponse)
-	if err != nil {
-		return "", err
+		body, mediaType, err = fetchManifestBody(ctx, client, ref, digest)
+		if err != nil {
+			return Manifest{}, nil, err
+		}
+		if mediaType != dockerManifestMediaType && mediaType != ociManifestMediaType {
+			return Manifest{}, nil, fmt.Errorf("manifest %s of %s has unexpected media type %q", digest, ref, mediaType)
+		}
+	case dockerManifestMediaType, ociManifestMediaType:
+	default:
+		return Manifest{}, nil, fmt.Errorf("unsupported manifest media type %q for %s", mediaType, ref)
 	}
 
-	return authResponse.Token, nil
+	var manifest Manifest
+	err = json.Unmarshal(body, &manifest)
+	if err != nil {
+		return Manifest{}, nil, fmt.Errorf("failed to decode manifest of %s: %w", ref, err)
+	}
+	manifest.MediaType = mediaType
+	return manifest, body, nil
 }
 
-func selectPlatformDigest(imageName, tag, token string) (string, error) {
-	url := fmt.Sprintf(dockerManifestUrl, imageName, tag)
+// fetchManifestBody downloads a manifest, verifies its digest and returns it with its media type.
+// The media type comes from the Content-Type header, or from the mediaType field
+// of the document when the registry sends a generic or no Content-Type.
+func fetchManifestBody(ctx context.Context, client *Client, ref Reference, identifier string) ([]byte, string, error) {
+	registryURL, err := client.registryURL(ctx, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	url := fmt.Sprintf(manifestURL, registryURL, ref.Repository, identifier)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
 
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.list.v2+json")
+	response, err := client.Do(ref, pullScope(ref.Repository), req)
+	if err != nil {
+		return nil, "", err
+	}
+	err = checkResponse(response)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
 
-	resp, err := http.DefaultClient.Do(req)
+	body, err := io.ReadAll(response.Body)
 	if err != nil {
-		return "", err
+		return nil, "", fmt.Errorf("failed to read manifest of %s: %w", ref, err)
 	}
-	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
+	// A manifest fetched by digest must match it; one fetched by tag is checked against the digest the registry reports.
+	expected := identifier
+	if !strings.Contains(identifier, ":") {
+		expected = response.Header.Get("Docker-Content-Digest")
+	}
+	if expected != "" {
+		err = verifyDigest(expected, body)
+		if err != nil {
+			return nil, "", fmt.Errorf("manifest %s of %s: %w", identifier, ref, err)
+		}
+	}
 
-	var manifestList ManifestList
-	if err := json.Unmarshal(body, &manifestList); err != nil {
-		return "", err
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if !slices.Contains(manifestMediaTypes, mediaType) {
+		var document struct {
+			MediaType string `json:"mediaType"`
+		}
+		_ = json.Unmarshal(body, &document)
+		mediaType = document.MediaType
 	}
+	return body, mediaType, nil
+}
 
-	currentOS := runtime.GOOS
-	currentArch := runtime.GOARCH
+// selectPlatformDigest returns the digest of the manifest in the list that best matches the platform.
+// Platforms compatible with it are tried in order of preference, e.g. linux/arm/v6 when no linux/arm/v7 image exists.
+func selectPlatformDigest(manifestList ManifestList, platform Platform) (string, error) {
+	for _, wanted := range compatiblePlatforms(platform) {
+		for _, m := range manifestList.Manifests {
+			if wanted.matches(m.Platform) {
+				return m.Digest, nil
+			}
+		}
+	}
 
+	var available []string
 	for _, m := range manifestList.Manifests {
-		if m.Platform.OS == currentOS && m.Platform.Architecture == currentArch {
-			return m.Digest, nil
+		// Attestation manifests in BuildKit images carry an unknown/unknown platform.
+		if m.Platform.OS != "unknown" {
+			available = append(available, NormalizePlatform(m.Platform).String())
 		}
 	}
-
-	return "", fmt.Errorf("no manifest found for platform %s/%s", currentOS, currentArch)
+	return "", fmt.Errorf("no manifest found for platform %s (available: %s)", platform, strings.Join(available, ", "))
 }
 
-// fetchManifest retrieves the manifest for a Docker image using the provided image name, tag, and authentication token.
-// It constructs the URL for the manifest, sends a GET request with the token in the header,
-// and decodes the response into a Manifest struct.
-// It returns the Manifest struct or an error if the request fails or decoding fails.
-// The manifest contains information about the image layers.
-func fetchManifest(imageName string, digest string, authToken string) (Manifest, error) {
-	var manifest Manifest
+// downloadLayer downloads a specific layer of an image using its digest from the manifest.
+// The layer is streamed into a partial file next to its final name; when a transient error interrupts it,
+// the download is retried with exponential backoff and resumes from the partial file with an HTTP Range request.
+// Only when the content matches the digest is the file renamed to a filename derived from the digest,
+// so a failed or partial download never appears as a layer.
+func downloadLayer(ctx context.Context, client *Client, ref Reference, layer Layer, dest string, p *progress, i int, stream *layerStream) error {
+	filePath := LayerPath(dest, layer)
+	partialPath := partialLayerPath(dest, layer)
+	var tee io.Writer = io.Discard
+	if stream != nil {
+		tee = stream
+	}
 
-	manifestURL := fmt.Sprintf(dockerManifestByDigestURL, imageName, digest)
-	req, err := http.NewRequest("GET", manifestURL, nil)
-	if err != nil {
-		return Manifest{}, err
+	_, err := os.Stat(filePath)
+	if err == nil {
+		p.setStatus(i, "Already exists")
+		return nil
 	}
 
-	req.Header.Set("Authorization", "Bearer "+authToken)
-	req.Header.Set("Accept", manifestMediaType)
+	delay := initialRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := fetchBlob(ctx, client, ref, layer.Digest, partialPath, p, i, tee)
+		if err == nil {
+			break
+		}
+		if attempt == maxDownloadAttempts || ctx.Err() != nil || !retryable(err) {
+			return fmt.Errorf("failed to download layer %s: %w", layer.Digest, err)
+		}
+
+		p.setStatus(i, fmt.Sprintf("Retrying in %s", delay))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
 
-	response, err := http.DefaultClient.Do(req)
+	err = os.Rename(partialPath, filePath)
 	if err != nil {
-		return Manifest{}, err
+		return err
 	}
+	p.setStatus(i, "Download complete")
+	return nil
+}
 
-	defer response.Body.Close()
+// fetchBlob downloads a blob into path, continuing after the bytes the file already holds.
+// The existing content is hashed first so the digest is verified over the whole blob.
+// A digest mismatch removes the file, because resuming it could never succeed.
+// Every chunk written to the file is also written to tee, which a layer stream uses to follow the download.
+func fetchBlob(ctx context.Context, client *Client, ref Reference, digest, path string, p *progress, i int, tee io.Writer) error {
+	v, err := newVerifier(digest)
+	if err != nil {
+		return err
+	}
 
-	body, _ := io.ReadAll(response.Body)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-	err = json.Unmarshal(body, &manifest)
+	offset, err := io.Copy(v, file)
+	if err != nil {
+		return err
+	}
+	p.setCurrent(i, offset)
 
-	return manifest, err
-}
+	// The request is cancelled when the body stalls, which the transport timeouts do not cover.
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stall := time.AfterFunc(stallTimeout, cancel)
+	defer stall.Stop()
 
-// downloadLayer downloads a specific layer of a Docker image using its digest from the manifest.
-// It constructs the URL for the layer, sends a GET request with the authentication token in the header,
-// and saves the layer to a file in the specified destination directory.
-// The layer is saved with a filename derived from its digest, ensuring unique identification.
-// It returns an error if the request fails or if there is an issue saving the file.
-func downloadLayer(digest string, imageName string, authToken string, dest string) error {
-	layerURL := fmt.Sprintf(dockerImageUrl, imageName, digest)
-	req, err := http.NewRequest("GET", layerURL, nil)
+	registryURL, err := client.registryURL(reqCtx, ref)
 	if err != nil {
 		return err
 	}
-
-	req.Header.Set("Authorization", "Bearer "+authToken)
-	response, err := http.DefaultClient.Do(req)
+	url := fmt.Sprintf(blobURL, registryURL, ref.Repository, digest)
+	req, err := http.NewRequestWithContext(reqCtx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 
+	response, err := client.Do(ref, pullScope(ref.Repository), req)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		response.Body.Close()
+		return restartBlob(file, "registry rejected the range request")
+	}
+	err = checkResponse(response)
+	if err != nil {
+		return err
+	}
 	defer response.Body.Close()
 
-	filePath := filepath.Join(dest, digestToFilename(digest))
-	outFile, err := os.Create(filePath)
+	// A registry that ignores the Range header sends the whole blob again.
+	if response.StatusCode != http.StatusPartialContent && offset > 0 {
+		v, _ = newVerifier(digest)
+		err = file.Truncate(0)
+		if err != nil {
+			return err
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		p.setCurrent(i, 0)
+	}
+
+	p.setStatus(i, "Downloading")
+	body := stallReader{r: response.Body, timer: stall}
+	_, err = io.Copy(io.MultiWriter(file, v, p.writer(i), tee), body)
+	if err != nil && reqCtx.Err() != nil && ctx.Err() == nil {
+		return fmt.Errorf("no data received for %s", stallTimeout)
+	}
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
 
-	_, err = io.Copy(outFile, response.Body)
-	return err
+	err = v.Verify()
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
 }
 
-// digestToFilename converts a Docker image layer digest to a filename.
-// It encodes the digest using URL-safe base64 encoding and appends a file extension.
+// restartBlob empties a partial file so the next attempt downloads the blob from the beginning.
+func restartBlob(file *os.File, reason string) error {
+	err := file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("restarting download: %s", reason)
+}
+
+// retryable reports whether a download error is transient: network failures, stalls and 408, 429 or 5xx responses.
+func retryable(err error) bool {
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusRequestTimeout ||
+			respErr.StatusCode == http.StatusTooManyRequests ||
+			respErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	var mismatch *DigestMismatchError
+	var pathErr *os.PathError
+	return !errors.As(err, &mismatch) && !errors.As(err, &pathErr)
+}
+
+// stallReader postpones the stall timer every time data arrives.
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s stallReader) Read(data []byte) (int, error) {
+	n, err := s.r.Read(data)
+	if n > 0 {
+		s.timer.Reset(stallTimeout)
+	}
+	return n, err
+}
+
+// partialLayerPath returns the path a layer is downloaded to before it is verified.
+func partialLayerPath(dir string, layer Layer) string {
+	return filepath.Join(dir, "."+layerFilename(layer)+partialExt)
+}
+
+// layerFilename converts a layer descriptor to a filename.
+// It encodes the digest using URL-safe base64 encoding and appends the file extension of the compression
+// the media type declares, .tar.gz for unknown media types.
 // This ensures that the filename is unique and can be safely used in a filesystem.
-// The resulting filename is suitable for storing the layer data in a tar.gz format.
-func digestToFilename(digest string) string {
-	return base64.URLEncoding.EncodeToString([]byte(digest)) + fileExt
+func layerFilename(layer Layer) string {
+	compression, ok := MediaTypeCompression(layer.MediaType)
+	if !ok {
+		compression = Gzip
+	}
+	return base64.URLEncoding.EncodeToString([]byte(layer.Digest)) + compressionExtensions[compression]
 }
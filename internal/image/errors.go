@@ -0,0 +1,68 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxErrorBody limits how much of an error response is read into a ResponseError.
+const maxErrorBody = 4096
+
+// ResponseError is returned when a registry answers with a status other than 2xx.
+// Code and Message are taken from the error body of the distribution API when the registry sends one.
+type ResponseError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Code       string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("request to %s failed: %s: %s: %s", e.URL, e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("request to %s failed: %s", e.URL, e.Status)
+}
+
+// DigestMismatchError is returned when downloaded content does not hash to the digest it was requested by.
+type DigestMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("digest mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// checkResponse returns a ResponseError for non-2xx responses and closes their body.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	respErr := &ResponseError{
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if json.Unmarshal(data, &body) == nil && len(body.Errors) > 0 {
+		respErr.Code = body.Errors[0].Code
+		respErr.Message = body.Errors[0].Message
+	} else if message := strings.TrimSpace(string(data)); message != "" && !strings.HasPrefix(message, "<") {
+		respErr.Message = message
+	}
+	return respErr
+}
@@ -0,0 +1,202 @@
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Platform describes the OS and CPU an image runs on, as in the platform object of OCI image indexes.
+type Platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+}
+
+// String returns the platform in the os/arch[/variant] form.
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ParsePlatform parses a platform specifier such as linux/arm/v7, linux/amd64 or arm64.
+// A specifier with a single component is an OS when it is a known one and an architecture otherwise,
+// the missing part coming from the host. The result is normalised.
+func ParsePlatform(specifier string) (Platform, error) {
+	parts := strings.Split(specifier, "/")
+	for _, part := range parts {
+		if part == "" {
+			return Platform{}, fmt.Errorf("invalid platform %q", specifier)
+		}
+	}
+
+	host := DefaultPlatform()
+	var p Platform
+	switch len(parts) {
+	case 1:
+		if isKnownOS(normalizeOS(parts[0])) {
+			p = Platform{OS: parts[0], Architecture: host.Architecture, Variant: host.Variant}
+		} else {
+			p = Platform{OS: host.OS, Architecture: parts[0]}
+		}
+	case 2:
+		p = Platform{OS: parts[0], Architecture: parts[1]}
+	case 3:
+		p = Platform{OS: parts[0], Architecture: parts[1], Variant: parts[2]}
+	default:
+		return Platform{}, fmt.Errorf("invalid platform %q", specifier)
+	}
+	return NormalizePlatform(p), nil
+}
+
+// DefaultPlatform returns the platform of the host, with the ARM variant read from /proc/cpuinfo.
+func DefaultPlatform() Platform {
+	return NormalizePlatform(Platform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+		Variant:      cpuVariant(),
+	})
+}
+
+// NormalizePlatform converts the aliases used by registries and uname to the canonical names, like containerd does:
+// x86_64 is amd64, aarch64 is arm64, whose v8 variant is the default and dropped, and arm without variant is arm/v7.
+func NormalizePlatform(p Platform) Platform {
+	p.OS = normalizeOS(p.OS)
+	p.Architecture, p.Variant = normalizeArch(p.Architecture, p.Variant)
+	return p
+}
+
+func normalizeOS(os string) string {
+	os = strings.ToLower(os)
+	if os == "macos" {
+		return "darwin"
+	}
+	return os
+}
+
+func isKnownOS(os string) bool {
+	switch os {
+	case "aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js", "linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows":
+		return true
+	}
+	return false
+}
+
+func normalizeArch(arch, variant string) (string, string) {
+	arch, variant = strings.ToLower(arch), strings.ToLower(variant)
+	switch arch {
+	case "i386":
+		arch, variant = "386", ""
+	case "x86_64", "x86-64", "amd64":
+		arch = "amd64"
+		if variant == "v1" {
+			variant = ""
+		}
+	case "aarch64", "arm64":
+		arch = "arm64"
+		switch variant {
+		case "8", "v8", "v8.0":
+			variant = ""
+		}
+	case "armhf":
+		arch, variant = "arm", "v7"
+	case "armel":
+		arch, variant = "arm", "v6"
+	case "arm":
+		switch variant {
+		case "", "7":
+			variant = "v7"
+		case "5", "6", "8":
+			variant = "v" + variant
+		}
+	}
+	return arch, variant
+}
+
+// compatiblePlatforms returns the platforms an image may be built for to run on p, from the best match down.
+// Older variants of an architecture are accepted, arm64 also runs arm, and amd64 also runs 386.
+func compatiblePlatforms(p Platform) []Platform {
+	p = NormalizePlatform(p)
+	platforms := []Platform{p}
+	with := func(arch, variant string) Platform {
+		return Platform{OS: p.OS, OSVersion: p.OSVersion, OSFeatures: p.OSFeatures, Architecture: arch, Variant: variant}
+	}
+
+	switch p.Architecture {
+	case "amd64":
+		level, err := strconv.Atoi(strings.TrimPrefix(p.Variant, "v"))
+		if err == nil {
+			// v1 is the baseline, which has no variant.
+			for level--; level > 1; level-- {
+				platforms = append(platforms, with("amd64", "v"+strconv.Itoa(level)))
+			}
+			if p.Variant != "" {
+				platforms = append(platforms, with("amd64", ""))
+			}
+		}
+		platforms = append(platforms, with("386", ""))
+	case "arm":
+		version, err := strconv.Atoi(strings.TrimPrefix(p.Variant, "v"))
+		if err == nil {
+			for version--; version >= 5; version-- {
+				platforms = append(platforms, with("arm", "v"+strconv.Itoa(version)))
+			}
+		}
+	case "arm64":
+		if p.Variant == "" || strings.HasPrefix(p.Variant, "v8") {
+			platforms = append(platforms, compatiblePlatforms(with("arm", "v8"))...)
+		}
+	}
+	return platforms
+}
+
+// matches reports whether a platform from a manifest list is the wanted platform.
+// A wanted OS version only matches the same version or a more specific one, e.g. 10.0.17763 matches 10.0.17763.5329.
+func (p Platform) matches(candidate Platform) bool {
+	candidate = NormalizePlatform(candidate)
+	if candidate.OS != p.OS || candidate.Architecture != p.Architecture || candidate.Variant != p.Variant {
+		return false
+	}
+	if p.OSVersion != "" && candidate.OSVersion != p.OSVersion && !strings.HasPrefix(candidate.OSVersion, p.OSVersion+".") {
+		return false
+	}
+	return true
+}
+
+// cpuVariant returns the ARM architecture version of the host CPU, e.g. v7, or an empty string on other CPUs.
+func cpuVariant() string {
+	if runtime.GOARCH != "arm" && runtime.GOARCH != "arm64" {
+		return ""
+	}
+
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(key) != "CPU architecture" {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		// Some ARMv8 kernels report the architecture as AArch64.
+		if value == "AArch64" {
+			value = "8"
+		}
+		_, variant := normalizeArch(runtime.GOARCH, value)
+		return variant
+	}
+	return ""
+}
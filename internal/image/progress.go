@@ -0,0 +1,185 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressBarWidth    = 50
+	progressRefreshRate = 100 * time.Millisecond
+	shortDigestLength   = 12
+)
+
+// progress reports the state of every layer of a pull like docker pull does.
+// On a terminal each layer has a line with a progress bar that is redrawn in place;
+// otherwise only state changes are printed, one line each, so logs stay readable.
+type progress struct {
+	out      io.Writer
+	terminal bool
+
+	mu     sync.Mutex
+	layers []*layerProgress
+	drawn  int
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// layerProgress is the state of one layer download.
+type layerProgress struct {
+	id      string
+	status  string
+	current int64
+	total   int64
+}
+
+// newProgress starts reporting progress for the layers to out.
+func newProgress(out io.Writer, layers []Layer) *progress {
+	p := &progress{out: out, done: make(chan struct{})}
+	if file, ok := out.(*os.File); ok {
+		info, err := file.Stat()
+		p.terminal = err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+
+	for _, layer := range layers {
+		p.layers = append(p.layers, &layerProgress{id: shortDigest(layer.Digest), status: "Pulling fs layer", total: layer.Size})
+	}
+
+	if p.terminal {
+		p.redraw()
+		p.wg.Add(1)
+		go p.refresh()
+	} else {
+		for _, layer := range p.layers {
+			fmt.Fprintf(p.out, "%s: %s\n", layer.id, layer.status)
+		}
+	}
+	return p
+}
+
+// refresh redraws the progress bars until the progress is stopped.
+func (p *progress) refresh() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(progressRefreshRate)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			p.redraw()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// setStatus changes the status of the layer at index i, e.g. to Downloading or Download complete.
+func (p *progress) setStatus(i int, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	layer := p.layers[i]
+	if layer.status == status {
+		return
+	}
+	layer.status = status
+	if !p.terminal {
+		fmt.Fprintf(p.out, "%s: %s\n", layer.id, status)
+	}
+}
+
+// setCurrent sets how many bytes of the layer at index i have been downloaded.
+func (p *progress) setCurrent(i int, current int64) {
+	p.mu.Lock()
+	p.layers[i].current = current
+	p.mu.Unlock()
+}
+
+// writer returns a writer that adds the bytes written to the progress of the layer at index i.
+func (p *progress) writer(i int) io.Writer {
+	return progressWriter{p: p, i: i}
+}
+
+// stop draws the final state and stops refreshing.
+func (p *progress) stop() {
+	close(p.done)
+	p.wg.Wait()
+	if p.terminal {
+		p.mu.Lock()
+		p.redraw()
+		p.mu.Unlock()
+	}
+}
+
+// redraw moves the cursor back to the first layer line and rewrites every line. The caller holds mu.
+func (p *progress) redraw() {
+	var b strings.Builder
+	if p.drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", p.drawn)
+	}
+	for _, layer := range p.layers {
+		fmt.Fprintf(&b, "\x1b[2K%s: %s", layer.id, layer.status)
+		if layer.status == "Downloading" {
+			b.WriteString(" " + progressBar(layer.current, layer.total))
+		}
+		b.WriteString("\n")
+	}
+	p.drawn = len(p.layers)
+	io.WriteString(p.out, b.String())
+}
+
+type progressWriter struct {
+	p *progress
+	i int
+}
+
+func (w progressWriter) Write(data []byte) (int, error) {
+	w.p.mu.Lock()
+	w.p.layers[w.i].current += int64(len(data))
+	w.p.mu.Unlock()
+	return len(data), nil
+}
+
+// progressBar renders a bar such as [=====>      ]  12.3MB/45.6MB.
+func progressBar(current, total int64) string {
+	if total <= 0 {
+		return formatBytes(current)
+	}
+
+	filled := int(float64(progressBarWidth) * float64(min(current, total)) / float64(total))
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return fmt.Sprintf("[%s] %8s/%s", bar, formatBytes(current), formatBytes(total))
+}
+
+// formatBytes formats a size with decimal units like docker pull.
+func formatBytes(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(n)
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// shortDigest returns the first 12 characters of the hex part of a digest, as docker pull and push show it.
+func shortDigest(digest string) string {
+	_, id, _ := strings.Cut(digest, ":")
+	if len(id) > shortDigestLength {
+		id = id[:shortDigestLength]
+	}
+	return id
+}
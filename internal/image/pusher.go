@@ -0,0 +1,314 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+const (
+	uploadURL = "%s/v2/%s/blobs/uploads/"
+
+	// DefaultChunkSize is the size above which blobs are uploaded in chunks rather than in a single request.
+	DefaultChunkSize = 64 * 1024 * 1024
+)
+
+// PushOptions configures how PushImage uploads an image.
+type PushOptions struct {
+	// Source is the reference the image was pulled from. Blobs are mounted from its repository
+	// instead of uploaded again when the target is another repository of the same registry.
+	Source *Reference
+	// ChunkSize is the size of the chunks large blobs are uploaded in; zero means DefaultChunkSize.
+	ChunkSize int64
+}
+
+// PushImage uploads the image stored in dir, as written by DownloadImage, to the registry of target.
+// Blobs the registry already has are skipped after a HEAD request, blobs of the source repository are mounted,
+// and the others are uploaded in a single request or in chunks when they are larger than the chunk size.
+// The config is uploaded like the layers, and the manifest is finally put under the tag or digest of target.
+func PushImage(ctx context.Context, dir string, target Reference, opts PushOptions) error {
+	rawManifest, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest Manifest
+	err = json.Unmarshal(rawManifest, &manifest)
+	if err != nil {
+		return fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = ociManifestMediaType
+	}
+
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+
+	client, err := NewClient()
+	if err != nil {
+		return err
+	}
+	p := &pusher{client: client, target: target, opts: opts}
+	if opts.Source != nil && opts.Source.Domain == target.Domain && opts.Source.Repository != target.Repository {
+		p.mountFrom = opts.Source.Repository
+	}
+
+	for _, layer := range manifest.Layers {
+		err := p.pushBlob(ctx, layer.Digest, LayerPath(dir, layer))
+		if err != nil {
+			return err
+		}
+	}
+	err = p.pushBlob(ctx, manifest.Config.Digest, filepath.Join(dir, ConfigFileName))
+	if err != nil {
+		return err
+	}
+
+	return p.putManifest(ctx, manifest.MediaType, rawManifest)
+}
+
+// pusher uploads the blobs and the manifest of one image to a repository.
+type pusher struct {
+	client    *Client
+	target    Reference
+	opts      PushOptions
+	mountFrom string
+}
+
+// scope returns the token scope for the push, which includes pulling from the repository blobs are mounted from.
+func (p *pusher) scope() string {
+	scope := pushScope(p.target.Repository)
+	if p.mountFrom != "" {
+		scope += " " + pullScope(p.mountFrom)
+	}
+	return scope
+}
+
+// pushBlob makes sure the registry has the blob stored in path.
+func (p *pusher) pushBlob(ctx context.Context, digest, path string) error {
+	exists, err := p.blobExists(ctx, digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		fmt.Printf("%s: Layer already exists\n", shortDigest(digest))
+		return nil
+	}
+
+	location, mounted, err := p.startUpload(ctx, digest)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		fmt.Printf("%s: Mounted from %s\n", shortDigest(digest), p.mountFrom)
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open blob %s: %w", digest, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: Pushing %s\n", shortDigest(digest), formatBytes(info.Size()))
+	if info.Size() > p.opts.ChunkSize {
+		location, err = p.uploadChunks(ctx, location, file, info.Size())
+		if err != nil {
+			return err
+		}
+		err = p.completeUpload(ctx, location, digest, nil, 0)
+	} else {
+		err = p.completeUpload(ctx, location, digest, file, info.Size())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload blob %s: %w", digest, err)
+	}
+	fmt.Printf("%s: Pushed\n", shortDigest(digest))
+	return nil
+}
+
+// blobExists checks with a HEAD request whether the repository already has the blob.
+func (p *pusher) blobExists(ctx context.Context, digest string) (bool, error) {
+	registryURL, err := p.client.registryURL(ctx, p.target)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, fmt.Sprintf(blobURL, registryURL, p.target.Repository, digest), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := p.client.Do(p.target, p.scope(), req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	default:
+		return false, checkResponse(resp)
+	}
+}
+
+// startUpload starts an upload session and returns its location.
+// When a repository to mount from is known, the registry is asked to mount the blob instead;
+// mounted is true when it did, and a registry that cannot mount starts a regular upload.
+func (p *pusher) startUpload(ctx context.Context, digest string) (string, bool, error) {
+	registryURL, err := p.client.registryURL(ctx, p.target)
+	if err != nil {
+		return "", false, err
+	}
+	uploadLocation := fmt.Sprintf(uploadURL, registryURL, p.target.Repository)
+	if p.mountFrom != "" {
+		uploadLocation += "?" + url.Values{"mount": {digest}, "from": {p.mountFrom}}.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadLocation, http.NoBody)
+	if err != nil {
+		return "", false, err
+	}
+	resp, err := p.client.Do(p.target, p.scope(), req)
+	if err != nil {
+		return "", false, err
+	}
+	err = checkResponse(resp)
+	if err != nil {
+		return "", false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusCreated {
+		return "", true, nil
+	}
+	location, err := uploadLocationOf(resp)
+	return location, false, err
+}
+
+// uploadChunks sends the blob in chunks with PATCH requests, following the location returned after each chunk.
+func (p *pusher) uploadChunks(ctx context.Context, location string, file *os.File, size int64) (string, error) {
+	for offset := int64(0); offset < size; offset += p.opts.ChunkSize {
+		length := min(p.opts.ChunkSize, size-offset)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPatch, location, io.NewSectionReader(file, offset, length))
+		if err != nil {
+			return "", err
+		}
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(file, offset, length)), nil
+		}
+		req.ContentLength = length
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+length-1))
+
+		resp, err := p.client.Do(p.target, p.scope(), req)
+		if err != nil {
+			return "", err
+		}
+		err = checkResponse(resp)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+
+		location, err = uploadLocationOf(resp)
+		if err != nil {
+			return "", err
+		}
+	}
+	return location, nil
+}
+
+// completeUpload closes the upload session with a PUT carrying the digest and, for monolithic uploads, the blob.
+func (p *pusher) completeUpload(ctx context.Context, location, digest string, file *os.File, size int64) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("invalid upload location %q: %w", location, err)
+	}
+	query := u.Query()
+	query.Set("digest", digest)
+	u.RawQuery = query.Encode()
+
+	var body io.Reader = http.NoBody
+	if file != nil {
+		body = io.NewSectionReader(file, 0, size)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(file, 0, size)), nil
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	resp, err := p.client.Do(p.target, p.scope(), req)
+	if err != nil {
+		return err
+	}
+	err = checkResponse(resp)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putManifest uploads the manifest under the tag, or the digest, of the target reference.
+func (p *pusher) putManifest(ctx context.Context, mediaType string, manifest []byte) error {
+	registryURL, err := p.client.registryURL(ctx, p.target)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut,
+		fmt.Sprintf(manifestURL, registryURL, p.target.Repository, p.target.Identifier()), bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	resp, err := p.client.Do(p.target, p.scope(), req)
+	if err != nil {
+		return err
+	}
+	err = checkResponse(resp)
+	if err != nil {
+		return fmt.Errorf("failed to put manifest: %w", err)
+	}
+	resp.Body.Close()
+
+	fmt.Printf("%s: digest: %s size: %d\n", p.target.Identifier(), resp.Header.Get("Docker-Content-Digest"), len(manifest))
+	return nil
+}
+
+// uploadLocationOf returns the absolute URL of the upload session from the Location header,
+// which registries may send relative to the request.
+func uploadLocationOf(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("registry returned no upload location: %s", resp.Status)
+	}
+
+	u, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location %q: %w", location, err)
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,262 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var registryPath = regexp.MustCompile(`^/v2/(.+)/(blobs/uploads|blobs|manifests)/(.*)$`)
+
+// memoryRegistry is an in-memory registry implementing the push side of the distribution API.
+// Blobs are stored per repository, and mounts are refused when mounts is false, as by registries without them.
+type memoryRegistry struct {
+	t      *testing.T
+	mounts bool
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	uploads   map[string]*bytes.Buffer
+	manifests map[string]string
+	patches   int
+	mounted   int
+}
+
+func newMemoryRegistry(t *testing.T, mounts bool) *memoryRegistry {
+	return &memoryRegistry{
+		t:         t,
+		mounts:    mounts,
+		blobs:     map[string][]byte{},
+		uploads:   map[string]*bytes.Buffer{},
+		manifests: map[string]string{},
+	}
+}
+
+func (m *memoryRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	match := registryPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		http.NotFound(w, r)
+		return
+	}
+	repository, kind, rest := match[1], match[2], match[3]
+
+	switch {
+	case kind == "blobs" && r.Method == http.MethodHead:
+		if _, ok := m.blobs[repository+"@"+rest]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case kind == "blobs/uploads" && r.Method == http.MethodPost:
+		digest, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from")
+		if blob, ok := m.blobs[from+"@"+digest]; ok && m.mounts {
+			m.blobs[repository+"@"+digest] = blob
+			m.mounted++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		id := strconv.Itoa(len(m.uploads))
+		m.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "blobs/uploads" && r.Method == http.MethodPatch:
+		upload := m.uploads[rest]
+		start := strconv.Itoa(upload.Len()) + "-"
+		if !strings.HasPrefix(r.Header.Get("Content-Range"), start) {
+			m.t.Errorf("chunk with Content-Range %q, want it to start at %s", r.Header.Get("Content-Range"), start)
+		}
+		io.Copy(upload, r.Body)
+		m.patches++
+		// Registries may move the session after every chunk.
+		id := strconv.Itoa(len(m.uploads))
+		m.uploads[id] = upload
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+id)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", upload.Len()-1))
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "blobs/uploads" && r.Method == http.MethodPut:
+		upload := m.uploads[rest]
+		io.Copy(upload, r.Body)
+		digest := r.URL.Query().Get("digest")
+		if digest != sha256Digest(upload.Bytes()) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors": [{"code": "DIGEST_INVALID", "message": "digest did not match"}]}`)
+			return
+		}
+		m.blobs[repository+"@"+digest] = upload.Bytes()
+		w.WriteHeader(http.StatusCreated)
+	case kind == "manifests" && r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		var manifest Manifest
+		json.Unmarshal(body, &manifest)
+		for _, blob := range append(manifest.Layers, manifest.Config) {
+			if _, ok := m.blobs[repository+"@"+blob.Digest]; !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `{"errors": [{"code": "MANIFEST_BLOB_UNKNOWN", "message": "%s"}]}`, blob.Digest)
+				return
+			}
+		}
+		m.manifests[repository+":"+rest] = r.Header.Get("Content-Type")
+		w.Header().Set("Docker-Content-Digest", sha256Digest(body))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// writeTestImage stores an image with the given layers in a new directory as DownloadImage does
+// and returns the directory and its manifest.
+func writeTestImage(t *testing.T, layers ...[]byte) (string, Manifest) {
+	t.Helper()
+	dir := t.TempDir()
+
+	config := []byte(`{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers"}}`)
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        Layer{MediaType: "application/vnd.oci.image.config.v1+json", Digest: sha256Digest(config), Size: int64(len(config))},
+	}
+	for _, data := range layers {
+		layer := Layer{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: sha256Digest(data), Size: int64(len(data))}
+		manifest.Layers = append(manifest.Layers, layer)
+		err := os.WriteFile(LayerPath(dir, layer), data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, ConfigFileName), config, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, ManifestFileName), rawManifest, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, manifest
+}
+
+// startRegistry serves the registry over TLS on the loopback interface, which the client treats as insecure,
+// and isolates the client from the credentials and registry configuration of the machine.
+func startRegistry(t *testing.T, registry http.Handler) string {
+	t.Helper()
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	t.Setenv(registryConfigEnv, filepath.Join(t.TempDir(), registryConfigName))
+
+	server := httptest.NewTLSServer(registry)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "https://")
+}
+
+func TestPushChunkedUpload(t *testing.T) {
+	registry := newMemoryRegistry(t, true)
+	domain := startRegistry(t, registry)
+
+	large := bytes.Repeat([]byte("0123456789"), 20)
+	small := []byte("small layer")
+	dir, manifest := writeTestImage(t, large, small)
+
+	target := Reference{Domain: domain, Repository: "team/app", Tag: "v1"}
+	err := PushImage(context.Background(), dir, target, PushOptions{ChunkSize: 75})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The config and the small layer fit in one request, the large layer takes chunks of 75, 75 and 50 bytes.
+	if registry.patches != 3 {
+		t.Errorf("%d chunks uploaded, want 3 chunks of at most 75 bytes for a 200 byte layer", registry.patches)
+	}
+	for _, blob := range append(manifest.Layers, manifest.Config) {
+		data, err := os.ReadFile(filepath.Join(dir, ConfigFileName))
+		if blob.Digest != manifest.Config.Digest {
+			data, err = os.ReadFile(LayerPath(dir, blob))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(registry.blobs["team/app@"+blob.Digest], data) {
+			t.Errorf("blob %s was not uploaded intact", blob.Digest)
+		}
+	}
+	if contentType := registry.manifests["team/app:v1"]; contentType != ociManifestMediaType {
+		t.Errorf("manifest put with content type %q, want %q", contentType, ociManifestMediaType)
+	}
+}
+
+func TestPushSkipsExistingBlobs(t *testing.T) {
+	registry := newMemoryRegistry(t, true)
+	domain := startRegistry(t, registry)
+
+	layer := bytes.Repeat([]byte("x"), 200)
+	dir, manifest := writeTestImage(t, layer)
+	registry.blobs["team/app@"+manifest.Layers[0].Digest] = layer
+
+	target := Reference{Domain: domain, Repository: "team/app", Tag: "v1"}
+	err := PushImage(context.Background(), dir, target, PushOptions{ChunkSize: 75})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry.patches != 0 {
+		t.Errorf("%d chunks uploaded for a layer the registry has", registry.patches)
+	}
+	if _, ok := registry.manifests["team/app:v1"]; !ok {
+		t.Error("manifest was not put")
+	}
+}
+
+func TestPushCrossRepositoryMount(t *testing.T) {
+	tests := []struct {
+		name    string
+		mounts  bool
+		mounted int
+		patches int
+	}{
+		{"registry mounts the blob", true, 1, 0},
+		{"registry without mounts falls back to an upload", false, 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newMemoryRegistry(t, tt.mounts)
+			domain := startRegistry(t, registry)
+
+			layer := bytes.Repeat([]byte("y"), 200)
+			dir, manifest := writeTestImage(t, layer)
+			registry.blobs["base/app@"+manifest.Layers[0].Digest] = layer
+
+			source := Reference{Domain: domain, Repository: "base/app", Tag: "latest"}
+			target := Reference{Domain: domain, Repository: "team/app", Tag: "v1"}
+			err := PushImage(context.Background(), dir, target, PushOptions{Source: &source, ChunkSize: 75})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if registry.mounted != tt.mounted || registry.patches != tt.patches {
+				t.Errorf("%d blobs mounted and %d chunks uploaded, want %d and %d", registry.mounted, registry.patches, tt.mounted, tt.patches)
+			}
+			if !bytes.Equal(registry.blobs["team/app@"+manifest.Layers[0].Digest], layer) {
+				t.Error("layer is missing from the target repository")
+			}
+			if _, ok := registry.manifests["team/app:v1"]; !ok {
+				t.Error("manifest was not put")
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	dockerHubDomain   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+	defaultTag        = "latest"
+	officialNamespace = "library/"
+)
+
+var (
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	tagRegexp           = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestRegexp        = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	domainRegexp        = regexp.MustCompile(`^(?:[A-Za-z0-9-]+\.)*[A-Za-z0-9-]+(?::[0-9]+)?$`)
+)
+
+// Reference identifies an image in a registry, e.g. ghcr.io/org/app:1.2 or node@sha256:<hex>.
+// Domain is the registry host (with an optional port), Repository the path inside it.
+// Tag and Digest are optional, but at least one is always set after parsing.
+type Reference struct {
+	Domain     string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image reference and normalises it like Docker does:
+// a missing domain means Docker Hub, single component Docker Hub names live in library/,
+// and a reference without tag or digest gets the latest tag.
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	name := s
+
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return Reference{}, fmt.Errorf("invalid digest in image reference %q", s)
+		}
+	}
+
+	// The tag separator is the last colon after the last slash, so a registry port is not mistaken for it.
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("invalid tag in image reference %q", s)
+		}
+	}
+
+	ref.Domain = dockerHubDomain
+	ref.Repository = name
+	if first, rest, ok := strings.Cut(name, "/"); ok && isDomain(first) {
+		ref.Domain = first
+		ref.Repository = rest
+	}
+	if ref.Domain == "index.docker.io" {
+		ref.Domain = dockerHubDomain
+	}
+	if ref.Domain == dockerHubDomain && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = officialNamespace + ref.Repository
+	}
+
+	if ref.Repository == "" {
+		return Reference{}, fmt.Errorf("invalid image reference %q: missing repository", s)
+	}
+	if !domainRegexp.MatchString(ref.Domain) {
+		return Reference{}, fmt.Errorf("invalid registry in image reference %q", s)
+	}
+	for _, component := range strings.Split(ref.Repository, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			return Reference{}, fmt.Errorf("invalid repository name in image reference %q", s)
+		}
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	return ref, nil
+}
+
+// isDomain reports whether the first path component of a reference is a registry host rather than a namespace.
+func isDomain(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost" || strings.ToLower(component) != component
+}
+
+// String returns the fully qualified form of the reference.
+func (r Reference) String() string {
+	s := r.Domain + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// familiarName returns the repository as Docker shows it, without the docker.io domain and library/ namespace.
+func (r Reference) familiarName() string {
+	if r.Domain != dockerHubDomain {
+		return r.Domain + "/" + r.Repository
+	}
+	return strings.TrimPrefix(r.Repository, officialNamespace)
+}
+
+// Identifier returns what the manifest is fetched by: the digest when pinned, the tag otherwise.
+func (r Reference) Identifier() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// registryURL returns the base URL of the registry API; Docker Hub is served from registry-1.docker.io.
+// Registries are reached over HTTPS, except insecure ones that only speak HTTP (see Client.challenge).
+func (r Reference) registryURL() string {
+	host := r.Domain
+	if host == dockerHubDomain {
+		host = dockerHubRegistry
+	}
+	return "https://" + host
+}
+
+// isLoopback reports whether the domain is a registry on the local machine, which Docker treats as insecure.
+func isLoopback(domain string) bool {
+	hostname := strings.Split(domain, ":")[0]
+	return hostname == "localhost" || strings.HasPrefix(hostname, "127.") || hostname == "[::1]"
+}
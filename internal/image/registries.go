@@ -0,0 +1,168 @@
+package image
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	registryConfigEnv    = "GOCKER_REGISTRY_CONFIG"
+	registryConfigName   = "registries.json"
+	systemRegistryConfig = "/etc/gocker/registries.json"
+)
+
+// RegistryConfig configures how registries are reached. It is read from $GOCKER_REGISTRY_CONFIG,
+// ~/.config/gocker/registries.json or /etc/gocker/registries.json, whichever is found first:
+//
+//	{
+//		"mirrors": {"docker.io": ["https://mirror.gcr.io", "http://cache.local:5000"]},
+//		"insecure-registries": ["registry.local:5000"],
+//		"ca-certs": {"registry.corp.example": "/etc/gocker/certs/corp-ca.pem"}
+//	}
+//
+// Mirrors are tried in order before the upstream registry when pulling. Insecure registries are reached over
+// HTTPS without certificate verification, falling back to plain HTTP, and ca-certs adds CA bundles per registry.
+type RegistryConfig struct {
+	Mirrors            map[string][]string `json:"mirrors,omitempty"`
+	InsecureRegistries []string            `json:"insecure-registries,omitempty"`
+	CACerts            map[string]string   `json:"ca-certs,omitempty"`
+}
+
+// LoadRegistryConfig reads the registry configuration. No configuration file means an empty configuration.
+func LoadRegistryConfig() (*RegistryConfig, error) {
+	paths := []string{systemRegistryConfig}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = slices.Insert(paths, 0, filepath.Join(dir, "gocker", registryConfigName))
+	}
+	if path := os.Getenv(registryConfigEnv); path != "" {
+		paths = []string{path}
+	}
+
+	config := &RegistryConfig{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		err = json.Unmarshal(data, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		return config, config.validate()
+	}
+	return config, nil
+}
+
+// validate checks that every mirror is a URL or host and normalises the registry keys.
+func (c *RegistryConfig) validate() error {
+	mirrors := map[string][]string{}
+	for upstream, list := range c.Mirrors {
+		for _, mirror := range list {
+			_, _, err := parseMirror(mirror)
+			if err != nil {
+				return err
+			}
+		}
+		mirrors[normalizeConfigKey(upstream)] = list
+	}
+	c.Mirrors = mirrors
+
+	certs := map[string]string{}
+	for registry, path := range c.CACerts {
+		certs[normalizeConfigKey(registry)] = path
+	}
+	c.CACerts = certs
+
+	for i, registry := range c.InsecureRegistries {
+		c.InsecureRegistries[i] = normalizeConfigKey(registry)
+	}
+	return nil
+}
+
+// insecure reports whether the registry is configured as insecure. Loopback registries always are, as in Docker.
+func (c *RegistryConfig) insecure(domain string) bool {
+	return isLoopback(domain) || (c != nil && slices.Contains(c.InsecureRegistries, domain))
+}
+
+// mirrorReferences returns ref as it is found on each mirror of its registry, in the configured order.
+// Mirrors serve the same repository names as the upstream, e.g. library/node for Docker Hub.
+// The base URL of every mirror is returned along, keyed by the mirror domain.
+func (c *RegistryConfig) mirrorReferences(ref Reference) ([]Reference, map[string]string) {
+	var refs []Reference
+	baseURLs := map[string]string{}
+	for _, mirror := range c.Mirrors[ref.Domain] {
+		domain, baseURL, err := parseMirror(mirror)
+		if err != nil {
+			continue
+		}
+
+		mirrorRef := ref
+		mirrorRef.Domain = domain
+		refs = append(refs, mirrorRef)
+		baseURLs[domain] = baseURL
+	}
+	return refs, baseURLs
+}
+
+// parseMirror splits a mirror, a URL such as http://cache.local:5000 or a bare host using HTTPS,
+// into the domain credentials are looked up for and the base URL of its API.
+func parseMirror(mirror string) (string, string, error) {
+	if !strings.Contains(mirror, "://") {
+		mirror = "https://" + mirror
+	}
+
+	u, err := url.Parse(mirror)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", "", fmt.Errorf("invalid registry mirror %q", mirror)
+	}
+	return u.Host, strings.TrimSuffix(u.Scheme+"://"+u.Host+u.Path, "/"), nil
+}
+
+// transport returns a transport for the registry trusting its configured CA bundle,
+// or skipping certificate verification for insecure registries. It returns nil when the default one fits.
+func (c *RegistryConfig) transport(base *http.Transport, domain string) (*http.Transport, error) {
+	var caPath string
+	hasCA := false
+	if c != nil {
+		caPath, hasCA = c.CACerts[domain]
+	}
+	if !hasCA && !c.insecure(domain) {
+		return nil, nil
+	}
+
+	transport := base.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+
+	if hasCA {
+		pem, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificates for %s: %w", domain, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caPath)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	if c.insecure(domain) {
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return transport, nil
+}
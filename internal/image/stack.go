@@ -0,0 +1,97 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Stack is an image of the layer store with more layers put on top of it, such as those of build steps
+// or the writable layer of a container. BaseDir is the directory of the image in the layer store,
+// and Layers, stored in LayersDir, are listed from the bottom with their DiffIDs and History entries.
+type Stack struct {
+	BaseDir   string    `json:"baseDir"`
+	LayersDir string    `json:"layersDir,omitempty"`
+	Layers    []Layer   `json:"layers,omitempty"`
+	DiffIDs   []string  `json:"diffIds,omitempty"`
+	History   []History `json:"history,omitempty"`
+}
+
+// Push returns a copy of the stack with a layer stored in LayersDir on top of it.
+func (s Stack) Push(layer Layer, diffID string, history History) Stack {
+	s.Layers = append(s.Layers[:len(s.Layers):len(s.Layers)], layer)
+	s.DiffIDs = append(s.DiffIDs[:len(s.DiffIDs):len(s.DiffIDs)], diffID)
+	s.History = append(s.History[:len(s.History):len(s.History)], history)
+	return s
+}
+
+// StoreStack stores a stack as a single image in dir, as DownloadImage would have stored it.
+// The manifest lists the layers of the base image followed by those of the stack, with the media types
+// of the manifest flavour of the base image, and config is the image configuration; its diff_ids and history
+// are those of the base image extended with the ones of the stack. Layer files are hard-linked when possible.
+func StoreStack(stack Stack, config ImageConfig, dir string) error {
+	base, err := LoadManifest(stack.BaseDir)
+	if err != nil {
+		return err
+	}
+	oci := base.MediaType == ociManifestMediaType
+
+	manifest := base
+	manifest.SchemaVersion = 2
+	manifest.Layers = nil
+	for _, layer := range base.Layers {
+		err := linkLayer(LayerPath(stack.BaseDir, layer), LayerPath(dir, layer))
+		if err != nil {
+			return err
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	for _, layer := range stack.Layers {
+		src := LayerPath(stack.LayersDir, layer)
+		compression, ok := MediaTypeCompression(layer.MediaType)
+		if ok {
+			layer.MediaType = layerMediaTypes[oci][compression]
+		}
+		err := linkLayer(src, LayerPath(dir, layer))
+		if err != nil {
+			return err
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs[:len(config.RootFS.DiffIDs):len(config.RootFS.DiffIDs)], stack.DiffIDs...)
+	config.History = append(config.History[:len(config.History):len(config.History)], stack.History...)
+	rawConfig, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode image config: %w", err)
+	}
+	manifest.Config.Digest = sha256Digest(rawConfig)
+	manifest.Config.Size = int64(len(rawConfig))
+
+	err = writeFileAtomic(filepath.Join(dir, ConfigFileName), rawConfig)
+	if err != nil {
+		return err
+	}
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, ManifestFileName), rawManifest)
+}
+
+// linkLayer hard-links a layer file to dst, or copies it when the files are on different filesystems.
+func linkLayer(src, dst string) error {
+	err := os.Link(src, dst)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		err = copyFile(src, dst)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store layer %s: %w", filepath.Base(src), err)
+	}
+	return nil
+}
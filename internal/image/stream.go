@@ -0,0 +1,123 @@
+package image
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// layerStream lets the layer applier read a layer while it downloads. It follows the partial file the download
+// writes, waiting for more data at its end, so the download keeps its resume and retry logic and is never held
+// back by the applier. A restarted download rewrites the same bytes, so the read offset stays valid.
+// The stream ends once the download is complete and its digest verified, and fails with the download.
+type layerStream struct {
+	ctx         context.Context
+	partialPath string
+	finalPath   string
+	file        *os.File
+	// read is set once the stream returned data to the applier.
+	read bool
+
+	mu      sync.Mutex
+	changed chan struct{}
+	done    bool
+	err     error
+}
+
+func newLayerStream(ctx context.Context, partialPath, finalPath string) *layerStream {
+	return &layerStream{ctx: ctx, partialPath: partialPath, finalPath: finalPath, changed: make(chan struct{})}
+}
+
+// Write is called with the bytes added to the partial file and wakes up a waiting reader.
+func (s *layerStream) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	s.notify()
+	s.mu.Unlock()
+	return len(data), nil
+}
+
+// finish marks the download as over, successfully when err is nil.
+func (s *layerStream) finish(err error) {
+	s.mu.Lock()
+	s.done = true
+	s.err = err
+	s.notify()
+	s.mu.Unlock()
+}
+
+// notify wakes up the waiting reader. The caller holds mu.
+func (s *layerStream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *layerStream) state() (bool, error, chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done, s.err, s.changed
+}
+
+func (s *layerStream) Read(data []byte) (int, error) {
+	for {
+		// The state is taken before reading, so reaching the end of a complete download is the end of the layer,
+		// and a change made after it wakes up the wait below.
+		done, err, changed := s.state()
+		if err != nil {
+			return 0, err
+		}
+
+		if s.file == nil {
+			s.file, err = os.Open(s.partialPath)
+			if os.IsNotExist(err) && done {
+				s.file, err = os.Open(s.finalPath)
+			}
+			if err != nil && !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+
+		if s.file != nil {
+			n, err := s.file.Read(data)
+			if n > 0 {
+				s.read = true
+				return n, nil
+			}
+			if err != io.EOF {
+				return 0, err
+			}
+			if done {
+				return 0, io.EOF
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-s.ctx.Done():
+			return 0, s.ctx.Err()
+		}
+	}
+}
+
+// wait blocks until the download is over and returns its error.
+func (s *layerStream) wait() error {
+	for {
+		done, err, changed := s.state()
+		if done {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// Close closes the file the stream reads.
+func (s *layerStream) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,372 @@
+package seccomp
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Offsets of the fields of struct seccomp_data.
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+
+	maxInstructions = 4096
+	maxJump         = 255
+
+	// jumpPass and jumpFail are symbolic jump targets resolved once the length of a block is known.
+	jumpPass = -1
+	jumpFail = -2
+)
+
+// compatArchitecture is an architecture whose programs the kernel runs besides those of the native one,
+// with its audit architecture and system call numbers.
+type compatArchitecture struct {
+	audit   uint32
+	numbers map[string]uint32
+}
+
+// instruction is a classic BPF instruction whose jump offsets may still be symbolic.
+type instruction struct {
+	code uint16
+	k    uint32
+	jt   int
+	jf   int
+}
+
+// Apply compiles the profile for a container holding the given capabilities
+// and installs it on every thread of the calling process.
+// The filter is inherited across exec, so it must be the last step before it.
+func Apply(profile *Profile, caps []string) error {
+	filter, err := Compile(profile, caps)
+	if err != nil {
+		return err
+	}
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("failed to load seccomp filter: %w", errno)
+	}
+	return nil
+}
+
+// Compile translates the profile into a classic BPF program for the native architecture and the compatibility
+// architectures the profile lists, such as 32-bit x86 and x32 on amd64, each filtered with its own system call numbers.
+// Seccomp only accepts classic BPF, so the program is assembled directly rather than through an eBPF toolchain.
+// System calls from any other architecture or ABI kill the process, so a profile cannot be bypassed through them,
+// and the architectures of the profile must include the native one when they are given.
+// Rules are evaluated in order and the first matching one decides; unknown system call names are skipped.
+func Compile(profile *Profile, caps []string) ([]unix.SockFilter, error) {
+	if seccompArch == 0 {
+		return nil, fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	err := profile.checkArchitectures()
+	if err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile: %w", err)
+	}
+
+	kernel, err := kernelVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	defaultAction, err := actionValue(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	native, err := compileSection(profile.Syscalls, caps, kernel, syscallNumbers, defaultAction)
+	if err != nil {
+		return nil, err
+	}
+	sections := [][]instruction{native}
+	// x32 system calls share the native audit architecture and are told apart by x32SyscallBit.
+	x32 := -1
+	var compat []archSection
+	compiled := map[string]bool{}
+	for _, name := range profile.Architectures {
+		arch, ok := compatArchitectures[name]
+		if !ok || compiled[name] {
+			continue
+		}
+		compiled[name] = true
+		section, err := compileSection(profile.Syscalls, caps, kernel, arch.numbers, defaultAction)
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, section)
+		if arch.audit == seccompArch {
+			x32 = len(sections) - 1
+		} else {
+			compat = append(compat, archSection{audit: arch.audit, section: len(sections) - 1})
+		}
+	}
+
+	program := dispatch(sections, x32, compat)
+	if len(program) > maxInstructions {
+		return nil, fmt.Errorf("seccomp filter has %d instructions, the kernel accepts at most %d", len(program), maxInstructions)
+	}
+	program, err = resolve(program, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := make([]unix.SockFilter, len(program))
+	for i, ins := range program {
+		filter[i] = unix.SockFilter{Code: ins.code, Jt: uint8(ins.jt), Jf: uint8(ins.jf), K: ins.k}
+	}
+	return filter, nil
+}
+
+// archSection is a compatibility architecture with an audit architecture of its own and the index of its section.
+type archSection struct {
+	audit   uint32
+	section int
+}
+
+// dispatch emits the instructions that jump to the section of the architecture of the system call, the first
+// section being the native one and x32 the index of the x32 section or -1, followed by the sections.
+// Sections are longer than the 255 instructions a conditional jump reaches, so they are entered with BPF_JA.
+// A system call of any other architecture or ABI kills the process.
+func dispatch(sections [][]instruction, x32 int, compat []archSection) []instruction {
+	load := func(offset uint32) instruction {
+		return instruction{code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, k: offset}
+	}
+	jump := func(op uint16, k uint32, jt, jf int) instruction {
+		return instruction{code: unix.BPF_JMP | op | unix.BPF_K, k: k, jt: jt, jf: jf}
+	}
+	kill := instruction{code: unix.BPF_RET | unix.BPF_K, k: unix.SECCOMP_RET_KILL_PROCESS}
+
+	// The offsets of the BPF_JA instructions are set once the length of the header is known.
+	header := []instruction{load(offsetArch)}
+	targets := map[int]int{}
+	enter := func(section int) {
+		targets[len(header)] = section
+		header = append(header, instruction{code: unix.BPF_JMP | unix.BPF_JA})
+	}
+
+	if x32SyscallBit != 0 {
+		header = append(header, jump(unix.BPF_JEQ, seccompArch, 0, 4), load(offsetNr), jump(unix.BPF_JGE, x32SyscallBit, 1, 0))
+		enter(0)
+		if x32 >= 0 {
+			enter(x32)
+		} else {
+			header = append(header, kill)
+		}
+	} else {
+		header = append(header, jump(unix.BPF_JEQ, seccompArch, 0, 1))
+		enter(0)
+	}
+	for _, arch := range compat {
+		header = append(header, jump(unix.BPF_JEQ, arch.audit, 0, 1))
+		enter(arch.section)
+	}
+	header = append(header, kill)
+
+	starts := make([]int, len(sections))
+	start := len(header)
+	for i, section := range sections {
+		starts[i] = start
+		start += len(section)
+	}
+	for at, section := range targets {
+		header[at].k = uint32(starts[section] - at - 1)
+	}
+	return slices.Concat(append([][]instruction{header}, sections...)...)
+}
+
+// compileSection emits the rules of a profile for the system call numbers of one architecture,
+// followed by the default action.
+func compileSection(syscalls []Syscall, caps []string, kernel [2]int, numbers map[string]uint32, defaultAction uint32) ([]instruction, error) {
+	var section []instruction
+	for _, syscall := range syscalls {
+		if !syscall.appliesTo(caps, kernel) {
+			continue
+		}
+
+		action, err := actionValue(syscall.Action, syscall.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range syscall.names() {
+			nr, ok := numbers[name]
+			if !ok {
+				continue
+			}
+
+			rule, err := compileRule(nr, syscall.Args, action)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compile rule for %s: %w", name, err)
+			}
+			section = append(section, rule...)
+		}
+	}
+	return append(section, instruction{code: unix.BPF_RET | unix.BPF_K, k: defaultAction}), nil
+}
+
+// compileRule emits the instructions that return action when the system call number is nr
+// and every argument condition holds, and otherwise fall through to the next rule.
+func compileRule(nr uint32, args []Arg, action uint32) ([]instruction, error) {
+	var blocks [][]instruction
+	for _, arg := range args {
+		block, err := compileArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	// A failed condition skips the remaining conditions and the return instruction.
+	var body []instruction
+	for i, block := range blocks {
+		failDist := 1
+		for _, next := range blocks[i+1:] {
+			failDist += len(next)
+		}
+		resolved, err := resolve(block, failDist)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, resolved...)
+	}
+	body = append(body, instruction{code: unix.BPF_RET | unix.BPF_K, k: action})
+
+	if len(body) > maxJump {
+		return nil, fmt.Errorf("rule is too long")
+	}
+
+	rule := []instruction{
+		{code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, k: offsetNr},
+		{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: nr, jf: len(body)},
+	}
+	return append(rule, body...), nil
+}
+
+// compileArg emits the comparison of a 64-bit argument as two 32-bit comparisons,
+// using jumpPass and jumpFail as the outcome of the condition.
+func compileArg(arg Arg) ([]instruction, error) {
+	if arg.Index > 5 {
+		return nil, fmt.Errorf("invalid argument index %d", arg.Index)
+	}
+
+	// Arguments are stored little endian, so the low word comes first.
+	lo := uint32(offsetArgs + 8*arg.Index)
+	hi := lo + 4
+	value := [2]uint32{uint32(arg.Value >> 32), uint32(arg.Value)}
+
+	load := func(offset uint32) instruction {
+		return instruction{code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, k: offset}
+	}
+	jump := func(op uint16, k uint32, jt, jf int) instruction {
+		return instruction{code: unix.BPF_JMP | op | unix.BPF_K, k: k, jt: jt, jf: jf}
+	}
+
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		return []instruction{
+			load(hi), jump(unix.BPF_JEQ, value[0], 0, jumpFail),
+			load(lo), jump(unix.BPF_JEQ, value[1], jumpPass, jumpFail),
+		}, nil
+	case "SCMP_CMP_NE":
+		return []instruction{
+			load(hi), jump(unix.BPF_JEQ, value[0], 0, jumpPass),
+			load(lo), jump(unix.BPF_JEQ, value[1], jumpFail, jumpPass),
+		}, nil
+	case "SCMP_CMP_GT":
+		return []instruction{
+			load(hi), jump(unix.BPF_JGT, value[0], jumpPass, 0), jump(unix.BPF_JEQ, value[0], 0, jumpFail),
+			load(lo), jump(unix.BPF_JGT, value[1], jumpPass, jumpFail),
+		}, nil
+	case "SCMP_CMP_GE":
+		return []instruction{
+			load(hi), jump(unix.BPF_JGT, value[0], jumpPass, 0), jump(unix.BPF_JEQ, value[0], 0, jumpFail),
+			load(lo), jump(unix.BPF_JGE, value[1], jumpPass, jumpFail),
+		}, nil
+	case "SCMP_CMP_LT":
+		return []instruction{
+			load(hi), jump(unix.BPF_JGT, value[0], jumpFail, 0), jump(unix.BPF_JEQ, value[0], 0, jumpPass),
+			load(lo), jump(unix.BPF_JGE, value[1], jumpFail, jumpPass),
+		}, nil
+	case "SCMP_CMP_LE":
+		return []instruction{
+			load(hi), jump(unix.BPF_JGT, value[0], jumpFail, 0), jump(unix.BPF_JEQ, value[0], 0, jumpPass),
+			load(lo), jump(unix.BPF_JGT, value[1], jumpFail, jumpPass),
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		mask := [2]uint32{uint32(arg.Value >> 32), uint32(arg.Value)}
+		want := [2]uint32{uint32(arg.ValueTwo >> 32), uint32(arg.ValueTwo)}
+		and := func(k uint32) instruction {
+			return instruction{code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, k: k}
+		}
+		return []instruction{
+			load(hi), and(mask[0]), jump(unix.BPF_JEQ, want[0], 0, jumpFail),
+			load(lo), and(mask[1]), jump(unix.BPF_JEQ, want[1], jumpPass, jumpFail),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported comparison operator %q", arg.Op)
+	}
+}
+
+// resolve replaces the symbolic jumps of a block: jumpPass continues after the block
+// and jumpFail skips failDist more instructions. Every offset is checked to fit in a jump.
+func resolve(block []instruction, failDist int) ([]instruction, error) {
+	resolved := make([]instruction, len(block))
+	for i, ins := range block {
+		offset := func(target int) (int, error) {
+			switch target {
+			case jumpPass:
+				target = len(block) - 1 - i
+			case jumpFail:
+				target = len(block) - 1 - i + failDist
+			}
+			if target < 0 || target > maxJump {
+				return 0, fmt.Errorf("jump offset %d out of range", target)
+			}
+			return target, nil
+		}
+
+		jt, err := offset(ins.jt)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := offset(ins.jf)
+		if err != nil {
+			return nil, err
+		}
+		resolved[i] = instruction{code: ins.code, k: ins.k, jt: jt, jf: jf}
+	}
+	return resolved, nil
+}
+
+// actionValue converts a profile action into the value returned by the filter.
+func actionValue(action string, errnoRet *uint) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		errno = uint32(*errnoRet)
+	}
+
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return unix.SECCOMP_RET_ALLOW, nil
+	case "SCMP_ACT_ERRNO":
+		return unix.SECCOMP_RET_ERRNO | (errno & unix.SECCOMP_RET_DATA), nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case "SCMP_ACT_TRAP":
+		return unix.SECCOMP_RET_TRAP, nil
+	case "SCMP_ACT_TRACE":
+		return unix.SECCOMP_RET_TRACE | (errno & unix.SECCOMP_RET_DATA), nil
+	case "SCMP_ACT_LOG":
+		return unix.SECCOMP_RET_LOG, nil
+	default:
+		return 0, fmt.Errorf("unsupported seccomp action %q", action)
+	}
+}
@@ -0,0 +1,283 @@
+package seccomp
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccompData is the struct seccomp_data a filter runs on.
+type seccompData struct {
+	nr   uint32
+	arch uint32
+	args [6]uint64
+}
+
+// run executes a filter on the data of a system call, as the kernel does, and returns its action.
+func run(t *testing.T, filter []unix.SockFilter, data seccompData) uint32 {
+	t.Helper()
+	var raw [64]byte
+	binary.LittleEndian.PutUint32(raw[offsetNr:], data.nr)
+	binary.LittleEndian.PutUint32(raw[offsetArch:], data.arch)
+	for i, arg := range data.args {
+		binary.LittleEndian.PutUint64(raw[offsetArgs+8*i:], arg)
+	}
+
+	var a uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		jump := func(cond bool) {
+			if cond {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		}
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			if ins.K%4 != 0 || ins.K >= uint32(len(raw)) {
+				t.Fatalf("instruction %d loads invalid offset %d", pc, ins.K)
+			}
+			a = binary.LittleEndian.Uint32(raw[ins.K:])
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			a &= ins.K
+		case unix.BPF_JMP | unix.BPF_JA:
+			pc += int(ins.K)
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			jump(a == ins.K)
+		case unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K:
+			jump(a > ins.K)
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			jump(a >= ins.K)
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("instruction %d has unexpected code %#x", pc, ins.Code)
+		}
+	}
+	t.Fatal("filter ended without returning")
+	return 0
+}
+
+func requireSeccomp(t *testing.T) {
+	t.Helper()
+	if seccompArch == 0 {
+		t.Skip("seccomp is not supported on this architecture")
+	}
+}
+
+var errnoEPERM = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+
+// allowProfile allows getpid, with the conditions of args, and denies everything else with EPERM.
+func allowProfile(architectures []string, args ...Arg) *Profile {
+	return &Profile{
+		DefaultAction: "SCMP_ACT_ERRNO",
+		Architectures: architectures,
+		Syscalls:      []Syscall{{Names: []string{"getpid"}, Action: "SCMP_ACT_ALLOW", Args: args}},
+	}
+}
+
+func compile(t *testing.T, profile *Profile) []unix.SockFilter {
+	t.Helper()
+	filter, err := Compile(profile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func TestCompileOperators(t *testing.T) {
+	requireSeccomp(t)
+	// The values differ in both words, so comparing a single one of them gives wrong results.
+	const value = 0x1_00000005
+
+	tests := map[string]struct {
+		arg     Arg
+		allowed []uint64
+		denied  []uint64
+	}{
+		"EQ": {
+			arg:     Arg{Value: value, Op: "SCMP_CMP_EQ"},
+			allowed: []uint64{value},
+			denied:  []uint64{0x2_00000005, 0x1_00000006, 5},
+		},
+		"NE": {
+			arg:     Arg{Value: value, Op: "SCMP_CMP_NE"},
+			allowed: []uint64{0x2_00000005, 0x1_00000006, 5},
+			denied:  []uint64{value},
+		},
+		"GT": {
+			arg:     Arg{Value: value, Op: "SCMP_CMP_GT"},
+			allowed: []uint64{0x1_00000006, 0x2_00000000},
+			denied:  []uint64{value, 0x1_00000004, 0x0_ffffffff},
+		},
+		"GE": {
+			arg:     Arg{Value: value, Op: "SCMP_CMP_GE"},
+			allowed: []uint64{value, 0x1_00000006, 0x2_00000000},
+			denied:  []uint64{0x1_00000004, 0x0_ffffffff},
+		},
+		"LT": {
+			arg:     Arg{Value: value, Op: "SCMP_CMP_LT"},
+			allowed: []uint64{0x1_00000004, 0x0_ffffffff},
+			denied:  []uint64{value, 0x1_00000006, 0x2_00000000},
+		},
+		"LE": {
+			arg:     Arg{Value: value, Op: "SCMP_CMP_LE"},
+			allowed: []uint64{value, 0x1_00000004, 0x0_ffffffff},
+			denied:  []uint64{0x1_00000006, 0x2_00000000},
+		},
+		"MASKED_EQ": {
+			arg:     Arg{Value: 0xff000000_0000ff00, ValueTwo: 0x12000000_00003400, Op: "SCMP_CMP_MASKED_EQ"},
+			allowed: []uint64{0x12000000_00003400, 0x12345678_9abc34ef},
+			denied:  []uint64{0x13000000_00003400, 0x12000000_00003500, 0},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// The argument is the third one, to check the offset of the words of every argument.
+			test.arg.Index = 2
+			filter := compile(t, allowProfile(nil, test.arg))
+
+			call := func(arg uint64) seccompData {
+				return seccompData{nr: syscallNumbers["getpid"], arch: seccompArch, args: [6]uint64{2: arg}}
+			}
+			for _, arg := range test.allowed {
+				if got := run(t, filter, call(arg)); got != unix.SECCOMP_RET_ALLOW {
+					t.Errorf("argument %#x returned %#x, want it allowed", arg, got)
+				}
+			}
+			for _, arg := range test.denied {
+				if got := run(t, filter, call(arg)); got != errnoEPERM {
+					t.Errorf("argument %#x returned %#x, want EPERM", arg, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileRules(t *testing.T) {
+	requireSeccomp(t)
+	profile := &Profile{
+		DefaultAction: "SCMP_ACT_ERRNO",
+		Syscalls: []Syscall{
+			// Every condition of a rule must hold.
+			{Names: []string{"getpid"}, Action: "SCMP_ACT_ALLOW", Args: []Arg{
+				{Index: 0, Value: 1, Op: "SCMP_CMP_EQ"},
+				{Index: 5, Value: 2, Op: "SCMP_CMP_EQ"},
+			}},
+			// The first matching rule decides.
+			{Names: []string{"getpid"}, Action: "SCMP_ACT_KILL_PROCESS", Args: []Arg{{Index: 0, Value: 1, Op: "SCMP_CMP_EQ"}}},
+			{Names: []string{"getpid", "getppid"}, Action: "SCMP_ACT_LOG"},
+			{Names: []string{"no_such_syscall"}, Action: "SCMP_ACT_ALLOW"},
+		},
+	}
+	filter := compile(t, profile)
+
+	tests := map[string]struct {
+		nr   uint32
+		args [6]uint64
+		want uint32
+	}{
+		"all conditions":      {nr: syscallNumbers["getpid"], args: [6]uint64{0: 1, 5: 2}, want: unix.SECCOMP_RET_ALLOW},
+		"failed condition":    {nr: syscallNumbers["getpid"], args: [6]uint64{0: 1, 5: 3}, want: unix.SECCOMP_RET_KILL_PROCESS},
+		"no condition":        {nr: syscallNumbers["getpid"], want: unix.SECCOMP_RET_LOG},
+		"second name":         {nr: syscallNumbers["getppid"], want: unix.SECCOMP_RET_LOG},
+		"default action":      {nr: syscallNumbers["gettid"], want: errnoEPERM},
+		"unknown system call": {nr: 0xffff, want: errnoEPERM},
+	}
+	for name, test := range tests {
+		got := run(t, filter, seccompData{nr: test.nr, arch: seccompArch, args: test.args})
+		if got != test.want {
+			t.Errorf("%s: returned %#x, want %#x", name, got, test.want)
+		}
+	}
+}
+
+func TestCompileArchitectures(t *testing.T) {
+	requireSeccomp(t)
+
+	native := seccompData{nr: syscallNumbers["getpid"], arch: seccompArch}
+	foreign := seccompData{nr: syscallNumbers["getpid"], arch: unix.AUDIT_ARCH_S390X}
+	for _, architectures := range [][]string{nil, {seccompArchName}} {
+		filter := compile(t, allowProfile(architectures))
+		if got := run(t, filter, native); got != unix.SECCOMP_RET_ALLOW {
+			t.Errorf("native system call with architectures %v returned %#x, want it allowed", architectures, got)
+		}
+		if got := run(t, filter, foreign); got != unix.SECCOMP_RET_KILL_PROCESS {
+			t.Errorf("foreign system call with architectures %v returned %#x, want the process killed", architectures, got)
+		}
+	}
+
+	for name, arch := range compatArchitectures {
+		t.Run(name, func(t *testing.T) {
+			allowed := seccompData{nr: arch.numbers["getpid"], arch: arch.audit}
+			denied := seccompData{nr: arch.numbers["getppid"], arch: arch.audit}
+
+			filter := compile(t, allowProfile([]string{seccompArchName, name}))
+			if got := run(t, filter, allowed); got != unix.SECCOMP_RET_ALLOW {
+				t.Errorf("listed getpid returned %#x, want it allowed", got)
+			}
+			if got := run(t, filter, denied); got != errnoEPERM {
+				t.Errorf("listed getppid returned %#x, want EPERM", got)
+			}
+			if got := run(t, filter, native); got != unix.SECCOMP_RET_ALLOW {
+				t.Errorf("native system call returned %#x, want it allowed", got)
+			}
+			if got := run(t, filter, foreign); got != unix.SECCOMP_RET_KILL_PROCESS {
+				t.Errorf("foreign system call returned %#x, want the process killed", got)
+			}
+
+			filter = compile(t, allowProfile([]string{seccompArchName}))
+			if got := run(t, filter, allowed); got != unix.SECCOMP_RET_KILL_PROCESS {
+				t.Errorf("unlisted getpid returned %#x, want the process killed", got)
+			}
+		})
+	}
+}
+
+func TestCompileDefaultProfile(t *testing.T) {
+	requireSeccomp(t)
+	// The sections of the architectures are far longer than a conditional jump reaches.
+	filter := compile(t, DefaultProfile())
+	if len(filter) > maxInstructions {
+		t.Fatalf("default profile has %d instructions", len(filter))
+	}
+
+	architectures := map[string]compatArchitecture{seccompArchName: {audit: seccompArch, numbers: syscallNumbers}}
+	for name, arch := range compatArchitectures {
+		architectures[name] = arch
+	}
+	for name, arch := range architectures {
+		if got := run(t, filter, seccompData{nr: arch.numbers["getpid"], arch: arch.audit}); got != unix.SECCOMP_RET_ALLOW {
+			t.Errorf("%s getpid returned %#x, want it allowed", name, got)
+		}
+		// mount is only allowed with CAP_SYS_ADMIN.
+		if got := run(t, filter, seccompData{nr: arch.numbers["mount"], arch: arch.audit}); got != errnoEPERM {
+			t.Errorf("%s mount returned %#x, want EPERM", name, got)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	block := []instruction{
+		{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, jt: 0, jf: jumpFail},
+		{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, jt: jumpPass, jf: jumpFail},
+	}
+	resolved, err := resolve(block, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]int{{0, 4}, {0, 3}}
+	for i, ins := range resolved {
+		if got := [2]int{ins.jt, ins.jf}; got != want[i] {
+			t.Errorf("instruction %d jumps %v, want %v", i, got, want[i])
+		}
+	}
+
+	_, err = resolve(block, maxJump)
+	if err == nil {
+		t.Error("jump beyond the reach of a conditional jump was resolved")
+	}
+}
@@ -0,0 +1,176 @@
+package seccomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Profile is a seccomp profile in the format used by Docker, which is a superset of the OCI runtime spec format.
+type Profile struct {
+	DefaultAction   string    `json:"defaultAction"`
+	DefaultErrnoRet *uint     `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string  `json:"architectures,omitempty"`
+	Syscalls        []Syscall `json:"syscalls,omitempty"`
+}
+
+// architectures are the architecture names seccomp profiles may list, as defined by libseccomp.
+var architectures = []string{
+	"SCMP_ARCH_X86", "SCMP_ARCH_X86_64", "SCMP_ARCH_X32",
+	"SCMP_ARCH_ARM", "SCMP_ARCH_AARCH64",
+	"SCMP_ARCH_MIPS", "SCMP_ARCH_MIPS64", "SCMP_ARCH_MIPS64N32",
+	"SCMP_ARCH_MIPSEL", "SCMP_ARCH_MIPSEL64", "SCMP_ARCH_MIPSEL64N32",
+	"SCMP_ARCH_PPC", "SCMP_ARCH_PPC64", "SCMP_ARCH_PPC64LE",
+	"SCMP_ARCH_S390", "SCMP_ARCH_S390X", "SCMP_ARCH_RISCV64",
+}
+
+// Syscall is a rule applied to one or more system calls.
+// All the argument conditions must match for the action to be taken.
+type Syscall struct {
+	Name     string   `json:"name,omitempty"`
+	Names    []string `json:"names,omitempty"`
+	Action   string   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	Args     []Arg    `json:"args,omitempty"`
+	Includes Filter   `json:"includes,omitempty"`
+	Excludes Filter   `json:"excludes,omitempty"`
+}
+
+// Arg is a condition on a system call argument.
+// For SCMP_CMP_MASKED_EQ, Value is the mask and ValueTwo the expected result.
+type Arg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+// Filter selects when a rule applies, based on the container capabilities,
+// the architecture and the running kernel version.
+type Filter struct {
+	Caps      []string `json:"caps,omitempty"`
+	Arches    []string `json:"arches,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// LoadProfile reads a Docker or OCI format seccomp profile from a JSON file.
+func LoadProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile: %w", err)
+	}
+
+	var profile Profile
+	err = json.Unmarshal(data, &profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode seccomp profile %s: %w", path, err)
+	}
+
+	if profile.DefaultAction == "" {
+		return nil, fmt.Errorf("seccomp profile %s has no defaultAction", path)
+	}
+	err = profile.checkArchitectures()
+	if err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+	}
+	return &profile, nil
+}
+
+// checkArchitectures validates the architectures the profile lists. The system calls of the native architecture
+// are always filtered, those of the listed compatibility architectures, such as SCMP_ARCH_X86 and SCMP_ARCH_X32 on
+// amd64, are filtered with their own numbers, and those of every other architecture or ABI are killed.
+// A profile listing architectures must therefore list the native one: it would otherwise kill every system call.
+func (p *Profile) checkArchitectures() error {
+	for _, name := range p.Architectures {
+		if !slices.Contains(architectures, name) {
+			return fmt.Errorf("unknown architecture %q", name)
+		}
+	}
+	if len(p.Architectures) > 0 && !slices.Contains(p.Architectures, seccompArchName) {
+		return fmt.Errorf("the native architecture %s is not listed in %v", seccompArchName, p.Architectures)
+	}
+	return nil
+}
+
+// names returns every system call name the rule applies to.
+func (s Syscall) names() []string {
+	if s.Name == "" {
+		return s.Names
+	}
+	return append([]string{s.Name}, s.Names...)
+}
+
+// appliesTo reports whether the rule is enabled for a container with the given capabilities
+// on the running architecture and kernel.
+func (s Syscall) appliesTo(caps []string, kernel [2]int) bool {
+	for _, c := range s.Includes.Caps {
+		if !slices.Contains(caps, c) {
+			return false
+		}
+	}
+	for _, c := range s.Excludes.Caps {
+		if slices.Contains(caps, c) {
+			return false
+		}
+	}
+
+	if len(s.Includes.Arches) > 0 && !slices.Contains(s.Includes.Arches, runtime.GOARCH) {
+		return false
+	}
+	if slices.Contains(s.Excludes.Arches, runtime.GOARCH) {
+		return false
+	}
+
+	if s.Includes.MinKernel != "" && compareKernel(kernel, s.Includes.MinKernel) < 0 {
+		return false
+	}
+	if s.Excludes.MinKernel != "" && compareKernel(kernel, s.Excludes.MinKernel) >= 0 {
+		return false
+	}
+	return true
+}
+
+// kernelVersion returns the major and minor version of the running kernel.
+func kernelVersion() ([2]int, error) {
+	var uname unix.Utsname
+	err := unix.Uname(&uname)
+	if err != nil {
+		return [2]int{}, fmt.Errorf("failed to get kernel version: %w", err)
+	}
+	return parseKernelVersion(unix.ByteSliceToString(uname.Release[:]))
+}
+
+// parseKernelVersion parses the major and minor numbers of a version such as 6.8.0-45-generic.
+func parseKernelVersion(release string) ([2]int, error) {
+	var version [2]int
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return version, fmt.Errorf("invalid kernel version: %s", release)
+	}
+
+	for i := range version {
+		digits := strings.TrimRightFunc(parts[i], func(r rune) bool { return r < '0' || r > '9' })
+		n, err := strconv.Atoi(digits)
+		if err != nil {
+			return version, fmt.Errorf("invalid kernel version: %s", release)
+		}
+		version[i] = n
+	}
+	return version, nil
+}
+
+// compareKernel compares the running kernel with a minimum version string, returning -1, 0 or 1.
+// An unparsable minimum version is treated as satisfied.
+func compareKernel(kernel [2]int, minimum string) int {
+	version, err := parseKernelVersion(minimum + ".0")
+	if err != nil {
+		return 1
+	}
+	return slices.Compare(kernel[:], version[:])
+}
@@ -0,0 +1,18 @@
+//go:build !amd64 && !arm64
+
+package seccomp
+
+// seccompArch is zero on architectures without a system call table, which disables seccomp filtering.
+const seccompArch = 0
+
+// seccompArchName is empty when seccomp filtering is disabled.
+const seccompArchName = ""
+
+// x32SyscallBit is unused when seccomp filtering is disabled.
+const x32SyscallBit = 0
+
+// compatArchitectures is empty when seccomp filtering is disabled.
+var compatArchitectures = map[string]compatArchitecture{}
+
+// syscallNumbers is empty on architectures without a system call table.
+var syscallNumbers = map[string]uint32{}
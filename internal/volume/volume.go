@@ -0,0 +1,90 @@
+package volume
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	volumesRoot = "/tmp/gocker/volumes"
+	dataDir     = "_data"
+	dirPerm     = 0o755
+)
+
+// Create creates a new anonymous volume and returns its generated name.
+// The volume data lives in /tmp/gocker/volumes/<name>/_data, mirroring the layout used by Docker.
+func Create() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate volume name: %w", err)
+	}
+
+	name := hex.EncodeToString(buf)
+	err = os.MkdirAll(Path(name), dirPerm)
+	if err != nil {
+		return "", fmt.Errorf("failed to create volume %s: %w", name, err)
+	}
+	return name, nil
+}
+
+// Path returns the host directory holding the data of the named volume.
+func Path(name string) string {
+	return filepath.Join(volumesRoot, name, dataDir)
+}
+
+// List returns the names of all volumes known to gocker.
+func List() ([]string, error) {
+	entries, err := os.ReadDir(volumesRoot)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Remove deletes the named volume and all of its data.
+func Remove(name string) error {
+	if name == "" || filepath.Base(name) != name {
+		return fmt.Errorf("invalid volume name: %q", name)
+	}
+
+	err := os.RemoveAll(filepath.Join(volumesRoot, name))
+	if err != nil {
+		return fmt.Errorf("failed to remove volume %s: %w", name, err)
+	}
+	return nil
+}
+
+// Prune removes every volume that is not present in inUse and returns the names of the removed volumes.
+func Prune(inUse map[string]bool) ([]string, error) {
+	names, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, name := range names {
+		if inUse[name] {
+			continue
+		}
+		err := Remove(name)
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
@@ -1,39 +1,641 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/marcospedro/gocker/internal/build"
 	"github.com/marcospedro/gocker/internal/container"
 	"github.com/marcospedro/gocker/internal/dockerfile"
+	"github.com/marcospedro/gocker/internal/image"
+	"github.com/marcospedro/gocker/internal/seccomp"
+	"github.com/marcospedro/gocker/internal/volume"
 )
 
 func main() {
-	cwd, err := os.Getwd()
+	commands := map[string]func([]string) error{
+		"run":    runCommand,
+		"build":  buildCommand,
+		"pull":   pullCommand,
+		"push":   pushCommand,
+		"save":   saveCommand,
+		"load":   loadCommand,
+		"rm":     rmCommand,
+		"diff":   diffCommand,
+		"commit": commitCommand,
+		"cp":     cpCommand,
+		"volume": volumeCommand,
+		"login":  loginCommand,
+		"logout": logoutCommand,
+		"init":   initCommand,
+	}
+
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		fmt.Printf("unknown command: %s\n", name)
+		os.Exit(1)
+	}
+
+	err := command(args)
 	if err != nil {
-		fmt.Printf("failed to get current working directory: %v\n", err)
+		fmt.Printf("%s failed: %v\n", name, err)
 		os.Exit(1)
 	}
+}
+
+// runCommand builds the root filesystem described by the Dockerfile in the current directory and runs it.
+// Arguments after the flags replace the default command of the image.
+func runCommand(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	var devices []container.Device
+	flags.Func("device", "add a host device to the container (host[:container[:permissions]])", func(spec string) error {
+		device, err := container.ParseDevice(spec)
+		if err != nil {
+			return err
+		}
+		devices = append(devices, device)
+		return nil
+	})
+	shmSize := container.DefaultShmSize
+	flags.Func("shm-size", "size of /dev/shm (e.g. 64m)", func(value string) error {
+		size, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		shmSize = size
+		return nil
+	})
+	var capAdd, capDrop []string
+	flags.Func("cap-add", "add a Linux capability", func(value string) error {
+		capAdd = append(capAdd, value)
+		return nil
+	})
+	flags.Func("cap-drop", "drop a Linux capability", func(value string) error {
+		capDrop = append(capDrop, value)
+		return nil
+	})
+	privileged := flags.Bool("privileged", false, "give extended privileges to the container")
+	options := addBuildFlags(flags)
+	readOnly := flags.Bool("read-only", false, "mount the container's root filesystem as read only")
+	var entrypoint *string
+	flags.Func("entrypoint", "overwrite the default entrypoint of the image", func(value string) error {
+		entrypoint = &value
+		return nil
+	})
+	var tmpfs []container.Tmpfs
+	flags.Func("tmpfs", "mount a tmpfs directory (path[:options])", func(spec string) error {
+		mount, err := container.ParseTmpfs(spec)
+		if err != nil {
+			return err
+		}
+		tmpfs = append(tmpfs, mount)
+		return nil
+	})
+	var seccompProfile *seccomp.Profile
+	seccompUnconfined := false
+	var noNewPrivileges *bool
+	flags.Func("security-opt", "security option (seccomp=<profile.json>|unconfined, no-new-privileges[=true|false])", func(value string) error {
+		name, option, _ := strings.Cut(value, "=")
+		switch {
+		case name == "no-new-privileges":
+			enabled := option == "" || option == "true"
+			if !enabled && option != "false" {
+				return fmt.Errorf("invalid value for no-new-privileges: %s", option)
+			}
+			noNewPrivileges = &enabled
+			return nil
+		case name == "seccomp" && option == "unconfined":
+			seccompUnconfined = true
+			return nil
+		case name == "seccomp" && option != "":
+			profile, err := seccomp.LoadProfile(option)
+			if err != nil {
+				return err
+			}
+			seccompProfile = profile
+			return nil
+		default:
+			return fmt.Errorf("unsupported security option: %s", value)
+		}
+	})
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	// Privileged containers run without a seccomp filter and without no_new_privs
+	// unless they are requested explicitly.
+	if seccompUnconfined {
+		seccompProfile = nil
+	} else if seccompProfile == nil && !*privileged {
+		seccompProfile = seccomp.DefaultProfile()
+	}
+	if noNewPrivileges == nil {
+		enabled := !*privileged
+		noNewPrivileges = &enabled
+	}
+
+	capabilities, err := container.Capabilities(capAdd, capDrop, *privileged)
+	if err != nil {
+		return err
+	}
+
+	rootfsPath, config, err := prepareDockerfile(*options)
+	if err != nil {
+		return err
+	}
+
+	// Like docker run, --entrypoint replaces the entrypoint and drops the default command,
+	// and the arguments after the flags replace the default command.
+	if entrypoint != nil {
+		config.Entrypoint = nil
+		if *entrypoint != "" {
+			config.Entrypoint = []string{*entrypoint}
+		}
+		config.Cmd = nil
+	}
+	if flags.NArg() > 0 {
+		config.Cmd = flags.Args()
+	}
+
+	return container.Run(container.Config{
+		Rootfs:          rootfsPath,
+		Layers:          config.Layers,
+		Image:           config.Image,
+		Entrypoint:      config.Entrypoint,
+		Cmd:             config.Cmd,
+		Env:             config.Env,
+		WorkingDir:      config.WorkingDir,
+		User:            config.User,
+		Volumes:         config.Volumes,
+		Devices:         devices,
+		ShmSize:         shmSize,
+		Capabilities:    capabilities,
+		Privileged:      *privileged,
+		Seccomp:         seccompProfile,
+		NoNewPrivileges: *noNewPrivileges,
+		ReadOnly:        *readOnly,
+		Tmpfs:           tmpfs,
+	})
+}
+
+// initCommand runs the init process of a container; gocker run starts it inside the new namespaces
+// with the configuration it prepared, so the Dockerfile is not processed again.
+func initCommand(args []string) error {
+	return container.Init()
+}
+
+// buildCommand builds the root filesystem described by the Dockerfile in the current directory without running it.
+func buildCommand(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	options := addBuildFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	rootfsPath, _, err := prepareDockerfile(*options)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Root filesystem ready at %s\n", rootfsPath)
+	return nil
+}
+
+// pullCommand downloads the layers of one or more images without building a root filesystem.
+func pullCommand(args []string) error {
+	flags := flag.NewFlagSet("pull", flag.ExitOnError)
+	download := &image.DownloadOptions{}
+	addDownloadFlags(flags, download)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("at least one image is required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for _, name := range flags.Args() {
+		ref, err := image.ParseReference(name)
+		if err != nil {
+			return err
+		}
+
+		_, err = build.Pull(ctx, ref, *download)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushCommand uploads an image of the layer store to a registry, under another name when a target is given.
+func pushCommand(args []string) error {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	var platform image.Platform
+	flags.Func("platform", "platform of the image to push (e.g. linux/arm64)", func(value string) error {
+		var err error
+		platform, err = image.ParsePlatform(value)
+		return err
+	})
+	chunkSize := int64(image.DefaultChunkSize)
+	flags.Func("chunk-size", "upload blobs larger than this in chunks (e.g. 64m)", func(value string) error {
+		size, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		chunkSize = size
+		return nil
+	})
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: gocker push [flags] <image> [<target>]")
+	}
+	source, err := image.ParseReference(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	target := source
+	if flags.NArg() == 2 {
+		target, err = image.ParseReference(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return build.Push(ctx, source, target, platform, image.PushOptions{ChunkSize: chunkSize})
+}
+
+// saveCommand writes images of the layer store to a tarball, standard output or an OCI layout directory.
+func saveCommand(args []string) error {
+	flags := flag.NewFlagSet("save", flag.ExitOnError)
+	output := flags.String("o", "", "write to a file (or directory for oci-dir) instead of standard output")
+	format := flags.String("format", image.DockerArchive, "archive format: docker-archive, oci-archive or oci-dir")
+	var platform image.Platform
+	flags.Func("platform", "platform of the images to save (e.g. linux/arm64)", func(value string) error {
+		var err error
+		platform, err = image.ParsePlatform(value)
+		return err
+	})
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("at least one image is required")
+	}
+	if *output == "" && *format != image.OCIDir && isTerminal(os.Stdout) {
+		return fmt.Errorf("refusing to write an archive to a terminal, use -o or redirect the output")
+	}
+
+	var refs []image.Reference
+	for _, name := range flags.Args() {
+		ref, err := image.ParseReference(name)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, ref)
+	}
+	return build.Save(refs, platform, *format, *output)
+}
+
+// loadCommand imports images from a docker-archive or OCI layout tarball, standard input or an OCI layout directory.
+func loadCommand(args []string) error {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	input := flags.String("i", "", "read from a tarball or OCI layout directory instead of standard input")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	loaded, err := build.Load(*input)
+	if err != nil {
+		return err
+	}
+	for _, img := range loaded {
+		fmt.Printf("Loaded image: %s (%s)\n", img.Reference, img.Platform)
+	}
+	return nil
+}
+
+// isTerminal reports whether the file is a character device, such as a terminal.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// addBuildFlags registers the flags controlling how base images are pulled and extracted and returns the options they set.
+func addBuildFlags(flags *flag.FlagSet) *build.Options {
+	options := &build.Options{}
+	addDownloadFlags(flags, &options.Download)
+	flags.BoolVar(&options.StreamLayers, "stream-layers", false, "extract layers while they download")
+	flags.BoolVar(&options.Download.DiscardLayers, "discard-layers", false, "with --stream-layers, delete the compressed layers once extracted, so the image cannot be saved or pushed")
+	return options
+}
+
+// addDownloadFlags registers the flags controlling image downloads into options.
+func addDownloadFlags(flags *flag.FlagSet, options *image.DownloadOptions) {
+	flags.IntVar(&options.MaxConcurrentDownloads, "max-concurrent-downloads", image.DefaultMaxConcurrentDownloads, "number of layers downloaded in parallel")
+	flags.Func("platform", "platform of the image to fetch (e.g. linux/arm64 or linux/arm/v7)", func(value string) error {
+		platform, err := image.ParsePlatform(value)
+		if err != nil {
+			return err
+		}
+		options.Platform = platform
+		return nil
+	})
+}
+
+// prepareDockerfile parses the Dockerfile in the current directory and prepares its root filesystem and configuration.
+func prepareDockerfile(options build.Options) (string, build.Config, error) {
+	if options.Download.DiscardLayers && !options.StreamLayers {
+		return "", build.Config{}, fmt.Errorf("--discard-layers requires --stream-layers")
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", build.Config{}, fmt.Errorf("failed to get current working directory: %w", err)
+	}
 
 	dockerfilePath := filepath.Join(cwd, "Dockerfile")
 	instructions, err := dockerfile.Parse(dockerfilePath)
 	if err != nil {
-		fmt.Printf("failed to parse Dockerfile: %v\n", err)
-		os.Exit(1)
+		return "", build.Config{}, fmt.Errorf("failed to parse Dockerfile: %w", err)
 	}
 
-	runner := build.NewRunner(instructions)
-	rootfsPath, entrypoint, err := runner.Prepare()
+	// Ctrl-C while the image is downloaded cancels the download instead of killing it halfway through a layer.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runner := build.NewRunner(instructions, options)
+	rootfsPath, config, err := runner.Prepare(ctx)
 	if err != nil {
-		fmt.Printf("failed to prepare runner: %v\n", err)
-		os.Exit(1)
+		return "", build.Config{}, fmt.Errorf("failed to prepare runner: %w", err)
 	}
+	return rootfsPath, config, nil
+}
 
-	err = container.Run(rootfsPath, entrypoint)
+// parseSize parses a human readable size such as 512k, 64m or 1g into bytes.
+// A value without a unit suffix is interpreted as bytes.
+func parseSize(value string) (int64, error) {
+	units := map[byte]int64{
+		'b': 1,
+		'k': 1024,
+		'm': 1024 * 1024,
+		'g': 1024 * 1024 * 1024,
+	}
+
+	value = strings.ToLower(strings.TrimSpace(value))
+	multiplier := int64(1)
+	if len(value) > 0 {
+		if unit, ok := units[value[len(value)-1]]; ok {
+			multiplier = unit
+			value = value[:len(value)-1]
+		}
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return size * multiplier, nil
+}
+
+// rmCommand removes one or more containers. With -v the anonymous volumes of the containers are removed too.
+func rmCommand(args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ExitOnError)
+	removeVolumes := flags.Bool("v", false, "remove anonymous volumes associated with the container")
+	err := flags.Parse(args)
 	if err != nil {
-		fmt.Printf("container run failed: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("at least one container id is required")
+	}
+
+	for _, id := range flags.Args() {
+		err := container.Remove(id, *removeVolumes)
+		if err != nil {
+			return err
+		}
+		fmt.Println(id)
+	}
+	return nil
+}
+
+// diffCommand lists the paths a container added (A), changed (C) or deleted (D) compared with its image.
+func diffCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: gocker diff <container>")
+	}
+
+	state, err := container.Load(args[0])
+	if err != nil {
+		return err
+	}
+	changes, err := build.Diff(state)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		fmt.Printf("%s %s\n", change.Kind, change.Path)
+	}
+	return nil
+}
+
+// commitCommand creates an image from the changes of a container.
+// Every --change is a Dockerfile instruction applied to the configuration of the image, e.g. --change 'CMD ["sh"]'.
+func commitCommand(args []string) error {
+	flags := flag.NewFlagSet("commit", flag.ExitOnError)
+	var changes []dockerfile.Instruction
+	addChange := func(value string) error {
+		change, err := dockerfile.ParseLine(value)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, change)
+		return nil
+	}
+	flags.Func("change", "apply a Dockerfile instruction to the image (CMD, ENTRYPOINT, ENV, WORKDIR, USER, VOLUME)", addChange)
+	flags.Func("c", "apply a Dockerfile instruction to the image (shorthand)", addChange)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: gocker commit [--change <instruction>]... <container> <repository[:tag]>")
+	}
+	state, err := container.Load(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	ref, err := image.ParseReference(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	err = build.Commit(state, ref, changes)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Committed container %s as %s\n", state.ID, ref)
+	return nil
+}
+
+// cpCommand copies files between the host and a container, in either direction:
+// gocker cp <container>:<path> <host path>|- and gocker cp <host path>|- <container>:<path>.
+// "-" stands for a tar archive written to standard output or read from standard input.
+func cpCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: gocker cp <container>:<path> <host path>|- or gocker cp <host path>|- <container>:<path>")
+	}
+
+	srcContainer, srcPath := splitCopyPath(args[0])
+	dstContainer, dstPath := splitCopyPath(args[1])
+	switch {
+	case srcContainer != "" && dstContainer == "":
+		if dstPath == "-" && isTerminal(os.Stdout) {
+			return fmt.Errorf("refusing to write an archive to a terminal, redirect the output")
+		}
+		state, err := container.Load(srcContainer)
+		if err != nil {
+			return err
+		}
+		return state.CopyFrom(srcPath, dstPath, os.Stdout)
+	case srcContainer == "" && dstContainer != "":
+		state, err := container.Load(dstContainer)
+		if err != nil {
+			return err
+		}
+		return state.CopyTo(srcPath, dstPath, os.Stdin)
+	default:
+		return fmt.Errorf("exactly one of the source and the destination must be a container path")
+	}
+}
+
+// splitCopyPath splits a gocker cp argument into the container and the path, e.g. abc123:/etc/hosts.
+// Host paths have no container: those without a colon, and those starting with / or . such as ./a:b.
+func splitCopyPath(arg string) (string, string) {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg
+	}
+	id, path, ok := strings.Cut(arg, ":")
+	if !ok {
+		return "", arg
+	}
+	return id, path
+}
+
+// volumeCommand manages volumes. The only subcommand is prune, which removes every volume not used by a container.
+func volumeCommand(args []string) error {
+	if len(args) == 0 || args[0] != "prune" {
+		return fmt.Errorf("usage: gocker volume prune")
+	}
+
+	inUse, err := container.VolumesInUse()
+	if err != nil {
+		return err
+	}
+
+	removed, err := volume.Prune(inUse)
+	for _, name := range removed {
+		fmt.Println(name)
+	}
+	return err
+}
+
+// loginCommand checks credentials against a registry and stores them in the Docker configuration.
+// The server defaults to Docker Hub; the password can be read from standard input with --password-stdin.
+func loginCommand(args []string) error {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	username := flags.String("username", "", "user name")
+	flags.StringVar(username, "u", "", "user name (shorthand)")
+	password := flags.String("password", "", "password or identity token")
+	flags.StringVar(password, "p", "", "password or identity token (shorthand)")
+	passwordStdin := flags.Bool("password-stdin", false, "read the password from standard input")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 1 {
+		return fmt.Errorf("usage: gocker login [flags] [server]")
+	}
+	domain := image.RegistryDomain(flags.Arg(0))
+
+	if *passwordStdin {
+		if *password != "" {
+			return fmt.Errorf("--password and --password-stdin are mutually exclusive")
+		}
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read password from stdin: %w", err)
+		}
+		*password = strings.TrimRight(string(input), "\r\n")
+	}
+	if *username == "" || *password == "" {
+		return fmt.Errorf("username and password are required")
+	}
+
+	creds := image.Credentials{Username: *username, Password: *password}
+	client, err := image.NewClient()
+	if err != nil {
+		return err
+	}
+	err = client.Login(domain, creds)
+	if err != nil {
+		return err
+	}
+
+	err = image.SaveCredentials(domain, creds)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Login Succeeded")
+	return nil
+}
+
+// logoutCommand removes the stored credentials of a registry, Docker Hub by default.
+func logoutCommand(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: gocker logout [server]")
+	}
+
+	server := ""
+	if len(args) == 1 {
+		server = args[0]
+	}
+	domain := image.RegistryDomain(server)
+
+	err := image.RemoveCredentials(domain)
+	if err != nil {
+		return err
 	}
+	fmt.Printf("Removing login credentials for %s\n", domain)
+	return nil
 }